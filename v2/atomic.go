@@ -0,0 +1,299 @@
+package sbrdata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// journalFile is the name of the file in the base directory listing the files of a save in progress
+const journalFile = "save.journal"
+
+const (
+	// stagedSuffix is appended to the name of a file to hold its new content until the save is committed
+	stagedSuffix = ".staged"
+	// rollbackSuffix is appended to the name of a file to keep its old content until the save is committed
+	rollbackSuffix = ".rollback"
+)
+
+// writeFileAtomic writes data to a temporary file next to name, flushes it to disk and renames it to name,
+// so name has either its old or its new content, even if the process crashes or the disk is full
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(name), fmt.Sprintf(".%s.*.tmp", filepath.Base(name)))
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_ = f.Close()
+	if err = writeFileSynced(tmp, data, perm); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, name); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	syncDirectory(filepath.Dir(name))
+	return nil
+}
+
+// writeFileSynced writes data to name and flushes it to disk before returning
+func writeFileSynced(name string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(name, perm)
+}
+
+// syncDirectory flushes the directory entries of directory to disk, making renames durable.
+// This is best effort, as not all platforms support syncing directories.
+func syncDirectory(directory string) {
+	d, err := os.Open(directory)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	_ = d.Close()
+}
+
+// journalEntry is a single file replaced or removed by a transaction
+type journalEntry struct {
+	// Name is the path of the file relative to the base directory
+	Name string
+	// Existed is true if the file existed before the transaction
+	Existed bool
+	// Remove is true if the file is removed instead of replaced
+	Remove bool `json:",omitempty"`
+}
+
+// journal is persisted while a transaction is committed to complete or undo it after a crash
+type journal struct {
+	// RollBack is true once the transaction failed and is undone
+	RollBack bool `json:",omitempty"`
+	// Entries are the files replaced or removed
+	Entries []journalEntry
+}
+
+// transaction replaces and removes a set of files in a base directory all-or-nothing. New content is staged
+// next to the files first. Committing writes a journal, keeps the old content as rollback file and renames the
+// staged files into place. If this fails, all files are restored. After a crash recoverTransaction completes
+// or undoes the transaction, depending on how far it got.
+type transaction struct {
+	// baseDirectory all names are relative to
+	baseDirectory string
+	// journal lists the staged changes
+	journal journal
+}
+
+// newTransaction creates an empty transaction for files in baseDirectory
+func newTransaction(baseDirectory string) *transaction {
+	return &transaction{baseDirectory: baseDirectory}
+}
+
+// path returns the path of a file of the transaction
+func (t *transaction) path(name string) string {
+	return filepath.Join(t.baseDirectory, name)
+}
+
+// write stages data as new content of the file name, relative to the base directory
+func (t *transaction) write(name string, data []byte, perm os.FileMode) error {
+	p := t.path(name)
+	if err := removeStale(p); err != nil {
+		return err
+	}
+	if err := writeFileSynced(p+stagedSuffix, data, perm); err != nil {
+		return err
+	}
+	_, err := os.Stat(p)
+	t.journal.Entries = append(t.journal.Entries, journalEntry{Name: name, Existed: err == nil})
+	return nil
+}
+
+// remove stages the removal of the file name, relative to the base directory
+func (t *transaction) remove(name string) error {
+	p := t.path(name)
+	if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err := removeStale(p); err != nil {
+		return err
+	}
+	t.journal.Entries = append(t.journal.Entries, journalEntry{Name: name, Existed: true, Remove: true})
+	return nil
+}
+
+// removeStale removes a rollback file left over by an earlier transaction, so it cannot be mistaken
+// for the old content of p when rolling back
+func removeStale(p string) error {
+	if err := os.Remove(p + rollbackSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// abort removes all staged files, leaving the files untouched
+func (t *transaction) abort() {
+	for _, e := range t.journal.Entries {
+		_ = os.Remove(t.path(e.Name) + stagedSuffix)
+	}
+	t.journal.Entries = nil
+}
+
+// commit applies all staged changes. If any change fails, all files are restored and the error is returned.
+func (t *transaction) commit() error {
+	if len(t.journal.Entries) == 0 {
+		return nil
+	}
+	if err := t.writeJournal(); err != nil {
+		t.abort()
+		return err
+	}
+	err := t.apply()
+	if err == nil {
+		t.finish()
+		return nil
+	}
+	t.journal.RollBack = true
+	if journalErr := t.writeJournal(); journalErr != nil {
+		return fmt.Errorf("%w, could not persist rollback: %w", err, journalErr)
+	}
+	if rollbackErr := t.rollBack(); rollbackErr != nil {
+		return fmt.Errorf("%w, could not roll back: %w", err, rollbackErr)
+	}
+	return err
+}
+
+// apply keeps the old content of all files as rollback file and moves the new content into place
+func (t *transaction) apply() error {
+	for _, e := range t.journal.Entries {
+		if !e.Existed {
+			continue
+		}
+		p := t.path(e.Name)
+		if err := os.Link(p, p+rollbackSuffix); err != nil {
+			if err = copy(p, p+rollbackSuffix, 1024); err != nil {
+				return err
+			}
+		}
+	}
+	for _, e := range t.journal.Entries {
+		p := t.path(e.Name)
+		var err error
+		if e.Remove {
+			err = os.Remove(p)
+		} else {
+			err = os.Rename(p+stagedSuffix, p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, e := range t.journal.Entries {
+		syncDirectory(filepath.Dir(t.path(e.Name)))
+	}
+	return nil
+}
+
+// rollForward completes a transaction whose journal was written, moving all staged files still present into place
+func (t *transaction) rollForward() error {
+	for _, e := range t.journal.Entries {
+		p := t.path(e.Name)
+		if e.Remove {
+			if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		if _, err := os.Stat(p + stagedSuffix); err == nil {
+			if err = os.Rename(p+stagedSuffix, p); err != nil {
+				return err
+			}
+		}
+	}
+	t.finish()
+	return nil
+}
+
+// rollBack restores the old content of all files and removes files created by the transaction
+func (t *transaction) rollBack() error {
+	for _, e := range t.journal.Entries {
+		p := t.path(e.Name)
+		if e.Existed {
+			if _, err := os.Stat(p + rollbackSuffix); err == nil {
+				if err = os.Rename(p+rollbackSuffix, p); err != nil {
+					return err
+				}
+			}
+			// renaming is a no-op if the rollback file is still a hard link to the unchanged file
+			if err := os.Remove(p + rollbackSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		} else if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := os.Remove(p + stagedSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Remove(t.path(journalFile))
+}
+
+// finish removes the rollback files and the journal of a completed transaction
+func (t *transaction) finish() {
+	for _, e := range t.journal.Entries {
+		_ = os.Remove(t.path(e.Name) + rollbackSuffix)
+	}
+	_ = os.Remove(t.path(journalFile))
+	syncDirectory(t.baseDirectory)
+}
+
+// writeJournal persists the journal in the base directory
+func (t *transaction) writeJournal() error {
+	data, err := json.MarshalIndent(t.journal, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(t.path(journalFile), data, 0600)
+}
+
+// recoverTransaction completes or undoes a transaction interrupted by a crash, if the base directory has a journal.
+// A transaction is completed unless it was already being rolled back, as all staged files were complete
+// before the journal was written. The caller must hold the lock of the base directory.
+func recoverTransaction(baseDirectory string, verbose bool) error {
+	data, err := os.ReadFile(filepath.Join(baseDirectory, journalFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t := newTransaction(baseDirectory)
+	if err = json.Unmarshal(data, &t.journal); err != nil {
+		return fmt.Errorf("could not read %s: %w", journalFile, err)
+	}
+	if t.journal.RollBack {
+		if verbose {
+			log.Printf("rolling back interrupted save of %d files", len(t.journal.Entries))
+		}
+		return t.rollBack()
+	}
+	if verbose {
+		log.Printf("completing interrupted save of %d files", len(t.journal.Entries))
+	}
+	return t.rollForward()
+}
@@ -0,0 +1,249 @@
+package sbrdata
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// newTestTransaction returns a transaction in a new base directory holding a.json and b.json, replacing a.json,
+// creating c.json and removing b.json
+func newTestTransaction(t *testing.T) *transaction {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range map[string]string{"a.json": "old a", "b.json": "old b"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx := newTransaction(dir)
+	if err := tx.write("a.json", []byte("new a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.write("c.json", []byte("new c"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.remove("b.json"); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+// assertFiles fails unless dir holds exactly the files in want with their content
+func assertFiles(t *testing.T, dir string, want map[string]string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names, wantNames []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	for name, content := range want {
+		wantNames = append(wantNames, name)
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if string(data) != content {
+			t.Errorf("%s: got %q, want %q", name, data, content)
+		}
+	}
+	slices.Sort(wantNames)
+	if !slices.Equal(names, wantNames) {
+		t.Errorf("got files %v, want %v", names, wantNames)
+	}
+}
+
+var (
+	oldFiles = map[string]string{"a.json": "old a", "b.json": "old b"}
+	newFiles = map[string]string{"a.json": "new a", "c.json": "new c"}
+)
+
+func TestTransactionCommit(t *testing.T) {
+	tx := newTestTransaction(t)
+	if err := tx.commit(); err != nil {
+		t.Fatal(err)
+	}
+	assertFiles(t, tx.baseDirectory, newFiles)
+}
+
+func TestTransactionAbort(t *testing.T) {
+	tx := newTestTransaction(t)
+	tx.abort()
+	assertFiles(t, tx.baseDirectory, oldFiles)
+	if err := tx.commit(); err != nil {
+		t.Fatal(err)
+	}
+	assertFiles(t, tx.baseDirectory, oldFiles)
+}
+
+func TestTransactionRollBackOnFailure(t *testing.T) {
+	tx := newTestTransaction(t)
+	// renaming c.json into place fails after a.json was replaced
+	if err := os.Remove(tx.path("c.json") + stagedSuffix); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.commit(); err == nil {
+		t.Fatal("expected error")
+	}
+	assertFiles(t, tx.baseDirectory, oldFiles)
+}
+
+func TestTransactionStaleRollback(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.json"), []byte("old a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a.json"+rollbackSuffix), []byte("stale"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tx := newTransaction(dir)
+	if err := tx.write("a.json", []byte("new a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.commit(); err != nil {
+		t.Fatal(err)
+	}
+	assertFiles(t, dir, map[string]string{"a.json": "new a"})
+}
+
+func TestRecoverTransaction(t *testing.T) {
+	tests := []struct {
+		name string
+		// crash leaves the base directory as a crash at some point of committing tx would
+		crash func(t *testing.T, tx *transaction)
+		want  map[string]string
+	}{
+		{
+			name:  "no journal",
+			crash: func(t *testing.T, tx *transaction) { tx.abort() },
+			want:  oldFiles,
+		},
+		{
+			name: "staged before journal",
+			crash: func(t *testing.T, tx *transaction) {
+				// staged files without journal are overwritten by the next save
+				for _, e := range tx.journal.Entries {
+					_ = os.Remove(tx.path(e.Name) + stagedSuffix)
+				}
+			},
+			want: oldFiles,
+		},
+		{
+			name: "journal written",
+			crash: func(t *testing.T, tx *transaction) {
+				if err := tx.writeJournal(); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: newFiles,
+		},
+		{
+			name: "partially applied",
+			crash: func(t *testing.T, tx *transaction) {
+				if err := tx.writeJournal(); err != nil {
+					t.Fatal(err)
+				}
+				for _, name := range []string{"a.json", "b.json"} {
+					if err := os.Link(tx.path(name), tx.path(name)+rollbackSuffix); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := os.Rename(tx.path("a.json")+stagedSuffix, tx.path("a.json")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: newFiles,
+		},
+		{
+			name: "applied before cleanup",
+			crash: func(t *testing.T, tx *transaction) {
+				if err := tx.writeJournal(); err != nil {
+					t.Fatal(err)
+				}
+				if err := tx.apply(); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: newFiles,
+		},
+		{
+			name: "rolling back",
+			crash: func(t *testing.T, tx *transaction) {
+				if err := tx.writeJournal(); err != nil {
+					t.Fatal(err)
+				}
+				if err := tx.apply(); err != nil {
+					t.Fatal(err)
+				}
+				tx.journal.RollBack = true
+				if err := tx.writeJournal(); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Rename(tx.path("a.json")+rollbackSuffix, tx.path("a.json")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: oldFiles,
+		},
+		{
+			name: "rollback journal written before apply",
+			crash: func(t *testing.T, tx *transaction) {
+				tx.journal.RollBack = true
+				if err := tx.writeJournal(); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: oldFiles,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := newTestTransaction(t)
+			tt.crash(t, tx)
+			if err := recoverTransaction(tx.baseDirectory, false); err != nil {
+				t.Fatal(err)
+			}
+			assertFiles(t, tx.baseDirectory, tt.want)
+			// recovering again is a no-op
+			if err := recoverTransaction(tx.baseDirectory, false); err != nil {
+				t.Fatal(err)
+			}
+			assertFiles(t, tx.baseDirectory, tt.want)
+		})
+	}
+}
+
+func TestRecoverLocked(t *testing.T) {
+	tx := newTestTransaction(t)
+	// a crash while committing leaves the journal and the lock of the save behind
+	if err := (&JSONStore{directory: tx.baseDirectory}).Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.writeJournal(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(tx.path("a.json"), tx.path("a.json")+rollbackSuffix); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tx.path("a.json")+stagedSuffix, tx.path("a.json")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewJSONStore(tx.baseDirectory); err == nil {
+		t.Fatal("opening a locked base directory with an unfinished save succeeded")
+	}
+	if _, err := os.Stat(tx.path(journalFile)); err != nil {
+		t.Fatalf("journal of the unfinished save is gone: %s", err)
+	}
+	if err := os.Remove(tx.path(lockFile)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewJSONStore(tx.baseDirectory); err != nil {
+		t.Fatal(err)
+	}
+	assertFiles(t, tx.baseDirectory, newFiles)
+}
@@ -0,0 +1,331 @@
+package sbrdata
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Backup is a backup copy of a collection file, named file.timestamp.ext or file.timestamp-sequence.ext
+// if more than one backup was created within the same second
+type Backup struct {
+	// Name is the path of the backup relative to the base directory
+	Name string
+	// Time is when the backup was created
+	Time time.Time
+	// Sequence orders backups created within the same second
+	Sequence int
+	// Size is the size of the backup file in bytes
+	Size int64
+}
+
+// BackupRetention decides which backups of a collection file are kept when a new backup is created.
+// A backup is kept if any rule keeps it, rules set to zero are disabled. Without any rule all backups are kept.
+// Days, weeks and months are determined in Location.
+type BackupRetention struct {
+	// Last keeps the newest backups
+	Last int
+	// Daily keeps the newest backup of each of the most recent days with backups
+	Daily int
+	// Weekly keeps the newest backup of each of the most recent ISO weeks with backups
+	Weekly int
+	// Monthly keeps the newest backup of each of the most recent months with backups
+	Monthly int
+	// Location is the time zone of days, weeks and months, nil for the local time zone. A GroupedCollection
+	// uses the time zone recorded in its base directory.
+	Location *time.Location
+}
+
+// keepsAll returns true if no rule is set
+func (r BackupRetention) keepsAll() bool {
+	return r.Last <= 0 && r.Daily <= 0 && r.Weekly <= 0 && r.Monthly <= 0
+}
+
+// keep returns the backups retained by r, backups must be sorted newest first
+func (r BackupRetention) keep(backups []Backup) map[string]bool {
+	result := make(map[string]bool)
+	for i := 0; i < r.Last && i < len(backups); i++ {
+		result[backups[i].Name] = true
+	}
+	periods := []struct {
+		count  int
+		period func(t time.Time) string
+	}{
+		{r.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{r.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%04d-W%02d", year, week)
+		}},
+		{r.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	location := r.Location
+	if location == nil {
+		location = time.Local
+	}
+	for _, p := range periods {
+		seen := make(map[string]bool)
+		for _, b := range backups {
+			if len(seen) >= p.count {
+				break
+			}
+			key := p.period(b.Time.In(location))
+			if !seen[key] {
+				seen[key] = true
+				result[b.Name] = true
+			}
+		}
+	}
+	return result
+}
+
+// stageBackup stages a copy of the collection file at p, inside the base directory of tx, as p.timestamp.ext
+// as part of tx. If backups were created within the same second already, the sequence number following the highest
+// one is added, so the order of the names always is the order of creation, even after backups were removed.
+// Nothing is staged if there is no file at p. Backups not kept by the retention are removed by pruneBackups once
+// tx is committed.
+func stageBackup(tx *transaction, p string) error {
+	fs, err := os.Stat(p)
+	if err != nil {
+		return nil
+	}
+	backups, err := backupsOf(p)
+	if err != nil {
+		return err
+	}
+	directory := filepath.Dir(p)
+	name, ext := splitExtension(fs.Name())
+	now := time.Now().Unix()
+	sequence := 0
+	for _, b := range backups {
+		if b.Time.Unix() == now && b.Sequence >= sequence {
+			sequence = b.Sequence + 1
+		}
+	}
+	dest := fmt.Sprintf("%s/%s.%d%s", directory, name, now, ext)
+	if sequence > 0 {
+		dest = fmt.Sprintf("%s/%s.%d-%d%s", directory, name, now, sequence, ext)
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	dest, err = filepath.Rel(tx.baseDirectory, dest)
+	if err != nil {
+		return err
+	}
+	return tx.write(filepath.ToSlash(dest), data, 0600)
+}
+
+// pruneBackups removes all backups of the collection file at p not kept by retention
+func pruneBackups(p string, retention BackupRetention) error {
+	if retention.keepsAll() {
+		return nil
+	}
+	backups, err := backupsOf(p)
+	if err != nil {
+		return err
+	}
+	keep := retention.keep(backups)
+	for _, b := range backups {
+		if keep[b.Name] {
+			continue
+		}
+		if err = os.Remove(path.Join(filepath.Dir(p), b.Name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupsOf returns the backups of the collection file at p, compressed or not, newest first.
+// Names are relative to the directory of p.
+func backupsOf(p string) ([]Backup, error) {
+	name, _ := splitExtension(filepath.Base(p))
+	items, err := os.ReadDir(filepath.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+	var result []Backup
+	for _, item := range items {
+		rest, ok := strings.CutPrefix(item.Name(), name+".")
+		if !ok || item.IsDir() {
+			continue
+		}
+		stamp, ok := cutCollectionExtension(rest)
+		if !ok {
+			continue
+		}
+		b, ok := parseBackupStamp(stamp)
+		if !ok {
+			continue
+		}
+		info, err := item.Info()
+		if err != nil {
+			return nil, err
+		}
+		b.Name = item.Name()
+		b.Size = info.Size()
+		result = append(result, b)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Time.Equal(result[j].Time) {
+			return result[i].Time.After(result[j].Time)
+		}
+		return result[i].Sequence > result[j].Sequence
+	})
+	return result, nil
+}
+
+// parseBackupStamp parses the timestamp[-sequence] part of the name of a backup
+func parseBackupStamp(stamp string) (Backup, bool) {
+	var b Backup
+	seconds, sequence, hasSequence := strings.Cut(stamp, "-")
+	if !isDigits(seconds) || (hasSequence && !isDigits(sequence)) {
+		return b, false
+	}
+	unix, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return b, false
+	}
+	b.Time = time.Unix(unix, 0)
+	if hasSequence {
+		if b.Sequence, err = strconv.Atoi(sequence); err != nil {
+			return b, false
+		}
+	}
+	return b, true
+}
+
+// Backups returns the backups of the collection with key, newest first. Backups are only supported by the JSONStore.
+// An error is returned if there is no collection with key.
+func (gc *GroupedCollection) Backups(key string) ([]Backup, error) {
+	store, ok := gc.store.(*JSONStore)
+	if !ok {
+		return nil, errors.New("backups require a JSON store")
+	}
+	key = gc.backupKey(key)
+	if _, ok = gc.collections[key]; !ok {
+		return nil, fmt.Errorf("no collection with key %q", key)
+	}
+	return store.Backups(key)
+}
+
+// Backups returns the backups of the collection with key, newest first
+func (s *JSONStore) Backups(key string) ([]Backup, error) {
+	backups, err := backupsOf(s.filePath(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range backups {
+		backups[i].Name = path.Join(path.Dir(s.fileName(key)), backups[i].Name)
+	}
+	return backups, nil
+}
+
+// RestoreBackup replaces the collection with key by the backup named name, as returned by Backups. The backup is
+// read and verified first, the current collection file is kept as backup. The collection file and the record counts
+// in the manifest are replaced all-or-nothing. Afterward, backups not kept by the retention set using
+// SetBackupRetention are removed. Unsaved changes of the collection are discarded.
+func (gc *GroupedCollection) RestoreBackup(key, name string) error {
+	store, ok := gc.store.(*JSONStore)
+	if !ok {
+		return errors.New("backups require a JSON store")
+	}
+	key = gc.backupKey(key)
+	backups, err := gc.Backups(key)
+	if err != nil {
+		return err
+	}
+	var found bool
+	for _, b := range backups {
+		found = found || b.Name == name
+	}
+	if !found {
+		return fmt.Errorf("%q is not a backup of collection %q", name, key)
+	}
+	if err = store.Lock(); err != nil {
+		return err
+	}
+	defer store.Unlock()
+	if err = gc.checkRevision(); err != nil {
+		return err
+	}
+	source := path.Join(store.Directory(), name)
+	// backups made before the base directory was encrypted may be restored
+	restored, err := loadCollection(source, store.key, false)
+	if err != nil {
+		return fmt.Errorf("could not restore %q: %w", name, err)
+	}
+	data, err := os.ReadFile(source)
+	if err != nil {
+		return err
+	}
+	// backups made before the base directory was encrypted are encrypted on restore
+	if !isEncrypted(data) {
+		if data, err = seal(data, store.key); err != nil {
+			return err
+		}
+	}
+	var counts RecordCounts
+	counts.add(restored)
+	m := gc.Manifest()
+	m.Counts[key] = counts
+	m.Revision++
+	manifest, err := m.marshal(gc.key)
+	if err != nil {
+		return err
+	}
+	tx := newTransaction(store.Directory())
+	if err = stageBackup(tx, store.existingFilePath(key)); err != nil {
+		tx.abort()
+		return err
+	}
+	if err = stageRestore(tx, store, key, name, data, manifest); err != nil {
+		tx.abort()
+		return err
+	}
+	if err = tx.commit(); err != nil {
+		return err
+	}
+	gc.manifest.Counts[key] = counts
+	gc.manifest.Revision = m.Revision
+	// the collection is read again on next access
+	gc.collections[key] = nil
+	return pruneBackups(store.existingFilePath(key), gc.retention)
+}
+
+// stageRestore stages data of the backup named name as collection file of key, keeping the extension of the backup,
+// and the manifest as part of tx. Files of the collection using another compression are removed.
+func stageRestore(tx *transaction, store *JSONStore, key, name string, data, manifest []byte) error {
+	_, ext := splitExtension(path.Base(name))
+	target := key + ext
+	if err := tx.write(target, data, 0600); err != nil {
+		return err
+	}
+	for _, other := range store.fileNames(key) {
+		if other == target {
+			continue
+		}
+		if err := tx.remove(other); err != nil {
+			return err
+		}
+	}
+	return tx.write(manifestFile, manifest, 0600)
+}
+
+// backupKey returns the key of the collection backups are listed for, without grouping the single collection
+func (gc *GroupedCollection) backupKey(key string) string {
+	if gc.groupPeriod == NoGrouping && key == "" {
+		return noGroupingMapKey
+	}
+	return key
+}
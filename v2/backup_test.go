@@ -0,0 +1,84 @@
+package sbrdata
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupRetentionLocation(t *testing.T) {
+	// the backups are made on different days in UTC, but on the same day west of it
+	backups := []Backup{
+		{Name: "newest", Time: time.Date(2023, 5, 11, 0, 30, 0, 0, time.UTC)},
+		{Name: "oldest", Time: time.Date(2023, 5, 10, 23, 30, 0, 0, time.UTC)},
+	}
+	tests := []struct {
+		name     string
+		location *time.Location
+		want     int
+	}{
+		{name: "UTC", location: time.UTC, want: 2},
+		{name: "west of UTC", location: time.FixedZone("UTC-4", -4*60*60), want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keep := BackupRetention{Daily: 2, Location: tt.location}.keep(backups)
+			if len(keep) != tt.want || !keep["newest"] {
+				t.Errorf("got %v, want %d backups including the newest", keep, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestoreBackup(t *testing.T) {
+	dir := t.TempDir()
+	gc := openTestCollection(t, dir, SetBackup())
+	for _, number := range []string{"+491711", "+491712"} {
+		if _, err := gc.AddCalls(Calls{Call: []Call{{Number: number, Date: may2023}}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := gc.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups, err := gc.Backups("2023/05")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("got %d backups, want 1", len(backups))
+	}
+	if gc.retention.Location != time.UTC {
+		t.Errorf("got retention in %s, want the time zone of the base directory", gc.retention.Location)
+	}
+
+	// a directory in place of the compressed collection file makes restoring fail when committing
+	blocker := filepath.Join(dir, "2023", "05.json.gz")
+	if err = os.Mkdir(blocker, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = gc.RestoreBackup("2023/05", backups[0].Name); err == nil {
+		t.Fatal("expected error")
+	}
+	if again, err := gc.Backups("2023/05"); err != nil || len(again) != 1 {
+		t.Fatalf("got %d backups, %v, want the backup of the failed restore rolled back", len(again), err)
+	}
+	if err = os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = gc.RestoreBackup("2023/05", backups[0].Name); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := gc.Backups("2023/05"); err != nil || len(again) != 2 {
+		t.Fatalf("got %d backups, %v, want the restored collection kept as backup", len(again), err)
+	}
+	calls, err := gc.AllCalls()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 || calls[0].Number != "+491711" {
+		t.Errorf("got %v, want the call of the backup", calls)
+	}
+}
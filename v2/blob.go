@@ -0,0 +1,267 @@
+package sbrdata
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const blobDirectory = "blobs"
+
+// BlobStore keeps MMS attachment payloads in a directory, addressed by the sha256 of their content.
+// Equal payloads are stored exactly once, no matter how often they are referenced. Encrypted blobs are
+// named by a keyed hash of their reference, see Path.
+type BlobStore struct {
+	// directory is where the blobs are persisted as <directory>/ab/abcdef...
+	directory string
+	// key encrypts the blobs, nil to store them unencrypted
+	key *EncryptionKey
+	// encryptedOnly refuses unencrypted blobs, as in encrypted base directories
+	encryptedOnly bool
+}
+
+// NewBlobStore creates a blob store persisting to directory, creating the directory if required
+func NewBlobStore(directory string) (*BlobStore, error) {
+	if strings.Trim(directory, " \t") == "" {
+		return nil, errors.New("directory must be non empty")
+	}
+	err := os.MkdirAll(directory, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &BlobStore{directory: directory}, nil
+}
+
+// SetEncryptionKey tells the blob store to encrypt blobs written afterward using key
+func (bs *BlobStore) SetEncryptionKey(key *EncryptionKey) {
+	bs.key = key
+}
+
+// Put stores data and returns the reference to retrieve it later on. The reference is computed from
+// the unencrypted content. If the content is already known, nothing is written.
+func (bs *BlobStore) Put(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	ref := hex.EncodeToString(sum[:])
+	p, err := bs.Path(ref)
+	if err != nil {
+		return "", err
+	}
+	if _, err = os.Stat(p); err == nil {
+		return ref, nil
+	}
+	err = os.MkdirAll(path.Dir(p), 0700)
+	if err != nil {
+		return "", err
+	}
+	data, err = seal(data, bs.key)
+	if err != nil {
+		return "", err
+	}
+	tmp := fmt.Sprintf("%s.tmp", p)
+	err = writeFileSynced(tmp, data, 0600)
+	if err != nil {
+		return "", err
+	}
+	return ref, os.Rename(tmp, p)
+}
+
+// Get returns the content stored for ref, decrypting it if required. Blobs written before the encryption key was
+// set are found by their reference as well.
+func (bs *BlobStore) Get(ref string) ([]byte, error) {
+	if len(ref) != sha256.Size*2 {
+		return nil, fmt.Errorf("invalid blob reference %q", ref)
+	}
+	p, err := bs.Path(ref)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) && bs.key != nil {
+		p, _ = blobPath(bs.directory, ref, nil)
+		data, err = os.ReadFile(p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err = unsealFrom(data, bs.key, bs.encryptedOnly)
+	if err != nil {
+		return nil, fmt.Errorf("could not read blob %q: %w", ref, err)
+	}
+	return data, nil
+}
+
+// Path returns the location of the blob with the given reference. With an encryption key the file is named by a
+// keyed hash of the reference instead of the reference itself, as the reference is the sha256 of the content.
+func (bs *BlobStore) Path(ref string) (string, error) {
+	return blobPath(bs.directory, ref, bs.key)
+}
+
+// Sweep removes all blobs whose reference is not in referenced and returns the number removed.
+// Temporary files of blobs being written are left alone.
+func (bs *BlobStore) Sweep(referenced map[string]bool) (int, error) {
+	keep := make(map[string]bool, 2*len(referenced))
+	for ref := range referenced {
+		p, err := bs.Path(ref)
+		if err != nil {
+			return 0, err
+		}
+		keep[p] = true
+		// blobs written before the encryption key was set
+		p, _ = blobPath(bs.directory, ref, nil)
+		keep[p] = true
+	}
+	removed := 0
+	err := filepath.WalkDir(bs.directory, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasSuffix(p, ".tmp") || keep[filepath.ToSlash(p)] {
+			return err
+		}
+		if err = os.Remove(p); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// blobPath returns the location of the blob with the given reference in directory, see BlobStore.Path
+func blobPath(directory, ref string, key *EncryptionKey) (string, error) {
+	name := ref
+	if key != nil {
+		var err error
+		if name, err = key.blobName(ref); err != nil {
+			return "", err
+		}
+	}
+	if len(name) < 2 {
+		return path.Join(directory, name), nil
+	}
+	return path.Join(directory, name[:2], name), nil
+}
+
+// extractParts moves the base64 payload of all parts of m into bs and replaces it with
+// the blob reference. The payload is stored right away, if the next save fails it is left
+// behind until RemoveUnreferencedBlobs removes it.
+func extractParts(bs BlobStorage, m *MMS) error {
+	for i := range m.Parts.Part {
+		p := &m.Parts.Part[i]
+		if p.Data == "" {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.Map(dropWhitespace, p.Data))
+		if err != nil {
+			return fmt.Errorf("could not decode data of part %q: %w", p.Seq, err)
+		}
+		ref, err := bs.Put(data)
+		if err != nil {
+			return err
+		}
+		p.Blob = ref
+		p.Data = ""
+	}
+	return nil
+}
+
+// dropWhitespace is used with strings.Map to remove line breaks and blanks
+// some exports put into base64 payloads
+func dropWhitespace(r rune) rune {
+	switch r {
+	case ' ', '\t', '\r', '\n':
+		return -1
+	}
+	return r
+}
+
+// addBlobReferences adds the references of all attachments of the MMS of c to referenced
+func addBlobReferences(referenced map[string]bool, c *Collection) {
+	for _, mms := range c.Mms {
+		for _, p := range mms.Parts.GetPart() {
+			if p.Blob != "" {
+				referenced[p.Blob] = true
+			}
+		}
+	}
+}
+
+// RemoveUnreferencedBlobs removes the attachments no record refers to, neither in the collections, their backups
+// nor in quarantine, e.g. attachments stored while adding records whose save failed afterward. Records not saved yet
+// are taken into account. The store is locked while removing and the revision of the manifest is counted up, so
+// processes that opened the base directory before have to open it again to save. It returns the number of
+// attachments removed. An error is returned if the blob storage of the store does not implement BlobSweeper.
+func (gc *GroupedCollection) RemoveUnreferencedBlobs() (int, error) {
+	sweeper, ok := gc.blobs.(BlobSweeper)
+	if !ok {
+		return 0, errors.New("blob storage does not support removing attachments")
+	}
+	if err := gc.store.Lock(); err != nil {
+		return 0, err
+	}
+	defer gc.store.Unlock()
+	referenced, err := gc.blobReferences()
+	if err != nil {
+		return 0, err
+	}
+	if err = gc.saveLocked(Batch{Documents: make(map[string][]byte)}); err != nil {
+		return 0, err
+	}
+	return sweeper.Sweep(referenced)
+}
+
+// blobReferences returns the references of all attachments of the collections including records not saved yet,
+// of their backups and of the quarantined records
+func (gc *GroupedCollection) blobReferences() (map[string]bool, error) {
+	referenced := make(map[string]bool)
+	store, _ := gc.store.(*JSONStore)
+	for key := range gc.collections {
+		c, err := gc.peek(key)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		addBlobReferences(referenced, c)
+		if store == nil {
+			continue
+		}
+		backups, err := store.Backups(key)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range backups {
+			backup, err := loadCollection(path.Join(store.Directory(), b.Name), store.key, false)
+			if err != nil {
+				return nil, fmt.Errorf("could not read backup %q: %w", b.Name, err)
+			}
+			addBlobReferences(referenced, backup)
+		}
+	}
+	addBlobReferences(referenced, quarantinedCollection(gc.quarantine.Records))
+	return referenced, nil
+}
+
+// copyBlobs copies the attachments referenced by the MMS of c from blobs to target
+func copyBlobs(c *Collection, blobs, target BlobStorage) error {
+	for _, mms := range c.Mms {
+		for _, p := range mms.Parts.GetPart() {
+			if p.Blob == "" {
+				continue
+			}
+			data, err := blobs.Get(p.Blob)
+			if err != nil {
+				return fmt.Errorf("could not copy attachment: %w", err)
+			}
+			if _, err = target.Put(data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
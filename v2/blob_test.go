@@ -0,0 +1,75 @@
+package sbrdata
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestRemoveUnreferencedBlobs(t *testing.T) {
+	dir := t.TempDir()
+	gc := openTestCollection(t, dir, SetBackup())
+	attachment := func(date, data string) Messages {
+		return Messages{Mms: []MMS{{Address: "+491711", Date: date, Parts: Parts{Part: []Part{{Seq: "0", Ct: "image/png", Data: data}}}}}}
+	}
+	if _, err := gc.AddMessages(attachment(may2023, "aGVsbG8=")); err != nil {
+		t.Fatal(err)
+	}
+	if err := gc.Save(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := gc.Get("2023/05")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the attachment is only referenced by the backup made by the next save
+	c.Mms[0].Parts.Part[0].Blob = ""
+	if _, err = gc.AddMessages(attachment("1683676800001", "d29ybGQ=")); err != nil {
+		t.Fatal(err)
+	}
+	if err = gc.Save(); err != nil {
+		t.Fatal(err)
+	}
+	orphan, err := gc.Blobs().Put([]byte("orphan"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = gc.AddMessages(attachment("1683676800002", "dW5zYXZlZA==")); err != nil {
+		t.Fatal(err)
+	}
+	stale := openTestCollection(t, dir)
+
+	removed, err := gc.RemoveUnreferencedBlobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("got %d removed attachments, want 1", removed)
+	}
+	if _, err = gc.Blobs().Get(orphan); err == nil {
+		t.Error("unreferenced attachment was kept")
+	}
+	for _, content := range []string{"hello", "world", "unsaved"} {
+		sum := sha256.Sum256([]byte(content))
+		if data, err := gc.Blobs().Get(hex.EncodeToString(sum[:])); err != nil || string(data) != content {
+			t.Errorf("got %q, %v, want attachment %q kept", data, err, content)
+		}
+	}
+	if _, err = stale.AddCalls(Calls{Call: []Call{{Number: "+491712", Date: may2023}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = stale.Save(); err == nil {
+		t.Error("saving a collection opened before removing attachments succeeded")
+	}
+}
+
+func TestPartPayloadData(t *testing.T) {
+	var p PartData = Part{Data: "aGVsbG8=", Blob: "ref"}
+	payload, ok := p.(PartPayloadData)
+	if !ok {
+		t.Fatal("Part does not implement PartPayloadData")
+	}
+	if payload.GetData() != "aGVsbG8=" || payload.GetBlob() != "ref" {
+		t.Errorf("got %q and %q, want the payload of the part", payload.GetData(), payload.GetBlob())
+	}
+}
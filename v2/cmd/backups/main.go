@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sascha-andres/sbrdata/v2"
+
+	"github.com/sascha-andres/reuse/flag"
+)
+
+var (
+	baseDirectory, key, passphrase, keyFile string
+	verbose                                 bool
+)
+
+// main is the entry point of the program.
+// It sets the prefix and flags for the logger, parses the command-line flags,
+// and calls the run function to list the backups.
+// If there is an error returned by run, it logs a fatal error and terminates the program.
+func main() {
+	log.SetPrefix("[SBR_BACKUPS_V2] ")
+	log.SetFlags(log.LstdFlags | log.LUTC | log.Lshortfile)
+
+	flag.SetEnvPrefix("SBR_BACKUPS_V2")
+	flag.StringVar(&baseDirectory, "base-directory", "", "pass path of data directory")
+	flag.StringVarWithoutEnv(&key, "key", "", "key of the collection to list backups for, e.g. 2023/05 when grouped monthly or 2023 when grouped yearly; leave empty without grouping")
+	flag.StringVar(&passphrase, "passphrase", "", "passphrase the data directory is encrypted with; prefer the environment variable")
+	flag.StringVar(&keyFile, "key-file", "", "key file the data directory is encrypted with instead of a passphrase")
+	flag.BoolVarWithoutEnv(&verbose, "verbose", false, "print more information")
+	flag.Parse()
+
+	err := run()
+	if err != nil {
+		log.Fatalf("error listing backups: %s", err)
+	}
+}
+
+// run prints the backups of the collection with key, newest first
+func run() error {
+	if baseDirectory == "" {
+		return errors.New("you have to provide base directory")
+	}
+	// reading must not create a mistyped data directory
+	if _, err := os.Stat(baseDirectory); err != nil {
+		return err
+	}
+	opts := []sbrdata.GroupedCollectionOption{
+		sbrdata.SetBaseDirectory(baseDirectory),
+	}
+	if verbose {
+		opts = append(opts, sbrdata.SetVerbose())
+	}
+	encryptionKey, err := sbrdata.NewEncryptionKey(passphrase, keyFile)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, sbrdata.SetEncryptionKey(encryptionKey))
+	gc, err := sbrdata.NewGroupedCollection(opts...)
+	if err != nil {
+		return err
+	}
+	backups, err := gc.Backups(key)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCREATED\tSIZE")
+	for _, b := range backups {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", b.Name, b.Time.In(gc.Location()).Format(time.DateTime), b.Size)
+	}
+	return w.Flush()
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"path"
+	"sort"
+	"text/tabwriter"
 
 	"github.com/sascha-andres/sbrdata/v2"
 
@@ -15,8 +20,13 @@ import (
 
 var (
 	baseDirectory, callFile, messageFile string
-	backup, verbose, configFile          bool
-	groupPeriod                          uint
+	identity, timezone, sqliteFile       string
+	compression, passphrase, keyFile     string
+	backup, verbose, configFile, refile  bool
+	removeUnreferencedBlobs              bool
+	groupPeriod, merge                   uint
+	keepLast, keepDaily                  uint
+	keepWeekly, keepMonthly              uint
 )
 
 // config is a type representing a configuration struct.
@@ -50,11 +60,24 @@ func main() {
 
 	flag.SetEnvPrefix("SBR_COLLECTION_V2")
 	flag.StringVar(&baseDirectory, "base-directory", "", "pass path of data directory")
-	flag.UintVar(&groupPeriod, "group-period", 99, "use 0 for no grouping, 1 for monthly and 2 for yearly")
+	flag.StringVar(&sqliteFile, "sqlite-file", "", "use the SQLite database file as archive instead of the data directory")
+	flag.UintVar(&groupPeriod, "group-period", 99, "use 0 for no grouping, 1 for monthly, 2 for yearly, 3 for daily, 4 for weekly (ISO), 5 for quarterly and 6 by counterpart; defaults to the one recorded in the data directory")
 	flag.StringVarWithoutEnv(&callFile, "call-file", "", "pass name/path of call file")
 	flag.StringVarWithoutEnv(&messageFile, "message-file", "", "pass name/path of message file")
 	flag.BoolVarWithoutEnv(&verbose, "verbose", false, "print more information")
 	flag.BoolVar(&backup, "backup", false, "do a backup of the file")
+	flag.UintVar(&keepLast, "keep-last", 0, "keep the most recent backups of each file, 0 keeps all unless another keep flag is used")
+	flag.UintVar(&keepDaily, "keep-daily", 0, "keep the most recent backup of each of the given number of days")
+	flag.UintVar(&keepWeekly, "keep-weekly", 0, "keep the most recent backup of each of the given number of weeks")
+	flag.UintVar(&keepMonthly, "keep-monthly", 0, "keep the most recent backup of each of the given number of months")
+	flag.BoolVarWithoutEnv(&refile, "refile", false, "try to file quarantined records from unparsed.json again, e.g. after fixing their dates")
+	flag.BoolVarWithoutEnv(&removeUnreferencedBlobs, "remove-unreferenced-blobs", false, "remove attachments no record or backup refers to after saving, e.g. left behind by a failed save")
+	flag.UintVar(&merge, "merge", 0, "update known records: 0 to skip them, 1 to fill empty fields and 2 to prefer the newer backup; requires identity content or number")
+	flag.StringVar(&identity, "identity", "", "how known records are detected: strict, content or number; defaults to strict, content when merging")
+	flag.StringVar(&timezone, "timezone", "", "time zone to group records in, e.g. UTC or Europe/Berlin; defaults to the one recorded in the base directory")
+	flag.StringVar(&compression, "compression", sbrdata.CompressionNameNone, "compression of the collection files written: none, gzip or zstd")
+	flag.StringVar(&passphrase, "passphrase", "", "passphrase the data directory is encrypted with; prefer the environment variable")
+	flag.StringVar(&keyFile, "key-file", "", "key file the data directory is encrypted with instead of a passphrase")
 	flag.BoolVar(&configFile, "use-config", false, "provide to use config file, named sbr.config located in collection dir")
 	flag.Parse()
 
@@ -68,19 +91,17 @@ func main() {
 // It returns an error if any of the actions fail.
 // The function checks if the base directory is empty and returns an error if it is.
 // It then creates a grouped collection by calling NewGroupedCollection function with the necessary options.
-// If a message file exists, it reads the file and unmarshals the data into a Messages struct.
-// It then adds the messages to the grouped collection using the AddMessages method.
-// If a call file exists, it reads the file and unmarshals the data into a Calls struct.
-// It then adds the calls to the grouped collection using the AddCalls method.
+// If a message file exists, it streams the messages into the grouped collection using the AddMessagesFromReader method.
+// If a call file exists, it streams the calls into the grouped collection using the AddCallsFromReader method.
 // Finally, it saves the grouped collection by calling the Save method.
 // The function logs the file being used for messages and calls, or any error related to the files.
 // `baseDirectory`, `callFile`, and `messageFile` are package-level variables used in the function.
 func run() error {
-	if baseDirectory == "" {
+	if baseDirectory == "" && sqliteFile == "" {
 		return errors.New("you have to provide collection file")
 	}
 
-	if configFile {
+	if configFile && baseDirectory != "" {
 		configFilePath := path.Join(baseDirectory, "sbr.config")
 		data, err := os.ReadFile(configFilePath)
 		if err != nil && !errors.Is(err, os.ErrNotExist) {
@@ -112,32 +133,63 @@ func run() error {
 	}
 
 	// create grouped collection
-	opts := make([]sbrdata.GroupedCollectionOption, 2)
-	opts[0] = sbrdata.SetBaseDirectory(baseDirectory)
-	opts[1] = sbrdata.SetGroupPeriod(sbrdata.GroupPeriod(groupPeriod))
+	opts := make([]sbrdata.GroupedCollectionOption, 1)
+	if sqliteFile != "" {
+		store, err := sbrdata.NewSQLiteStore(sqliteFile)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		opts[0] = sbrdata.SetStore(store)
+	} else {
+		opts[0] = sbrdata.SetBaseDirectory(baseDirectory)
+	}
+	if groupPeriod != 99 {
+		opts = append(opts, sbrdata.SetGroupPeriod(sbrdata.GroupPeriod(groupPeriod)))
+	}
 	if verbose {
 		opts = append(opts, sbrdata.SetVerbose())
 	}
 	if backup {
-		opts = append(opts, sbrdata.SetBackup())
+		opts = append(opts, sbrdata.SetBackup(), sbrdata.SetBackupRetention(sbrdata.BackupRetention{
+			Last:    int(keepLast),
+			Daily:   int(keepDaily),
+			Weekly:  int(keepWeekly),
+			Monthly: int(keepMonthly),
+		}))
+	}
+	if timezone != "" {
+		opts = append(opts, sbrdata.SetTimezone(timezone))
 	}
+	if identity != "" {
+		id, err := sbrdata.IdentityByName(identity)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, sbrdata.SetIdentity(id))
+	}
+	if merge > uint(sbrdata.MergePreferNewer) {
+		return errors.New("merge must be 0, 1 or 2")
+	}
+	c, err := sbrdata.CompressionByName(compression)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, sbrdata.SetCompression(c))
+	key, err := sbrdata.NewEncryptionKey(passphrase, keyFile)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, sbrdata.SetEncryptionKey(key))
+	opts = append(opts, sbrdata.SetMerge(sbrdata.MergeMode(merge)))
 	gc, err := sbrdata.NewGroupedCollection(opts...)
 	if err != nil {
 		return err
 	}
+	result := make(map[string]*sbrdata.ImportResult)
 	if _, err = os.Stat(messageFile); err == nil {
 		log.Printf("using %q as message file", messageFile)
-		var messages sbrdata.Messages
-		var data []byte
-		data, err = os.ReadFile(messageFile)
-		if err != nil {
-			return err
-		}
-		err = xml.Unmarshal(data, &messages)
-		if err != nil {
-			return err
-		}
-		if err = gc.AddMessages(messages); err != nil {
+		if err = addFromFile(messageFile, gc.AddMessagesFromReader, result); err != nil {
 			return err
 		}
 	} else {
@@ -145,21 +197,79 @@ func run() error {
 	}
 	if _, err = os.Stat(callFile); err == nil {
 		log.Printf("using %q as call file", callFile)
-		var calls sbrdata.Calls
-		var data []byte
-		data, err = os.ReadFile(callFile)
-		if err != nil {
+		if err = addFromFile(callFile, gc.AddCallsFromReader, result); err != nil {
 			return err
 		}
-		err = xml.Unmarshal(data, &calls)
+	} else {
+		log.Printf("no call file or error: %s", err)
+	}
+	if refile {
+		log.Printf("refiling %d quarantined records", len(gc.Quarantined()))
+		r, err := gc.Refile(nil)
+		result["unparsed.json"] = r
 		if err != nil {
 			return err
 		}
-		if err = gc.AddCalls(calls); err != nil {
+	}
+	if n := len(gc.Quarantined()); n > 0 {
+		log.Printf("%d records with unparsable dates are quarantined in unparsed.json", n)
+	}
+	if changes := gc.Changes(); len(changes) > 0 {
+		log.Printf("updated %d fields of known records", len(changes))
+	}
+	if err = gc.Save(); err != nil {
+		return err
+	}
+	if removeUnreferencedBlobs {
+		n, err := gc.RemoveUnreferencedBlobs()
+		if err != nil {
 			return err
 		}
-	} else {
-		log.Printf("no call file or error: %s", err)
+		log.Printf("removed %d unreferenced attachments", n)
+	}
+	return printSummary(result)
+}
+
+// addFromFile opens the file at path and hands it to add, closing it afterward.
+// The import result is stored in results using path as key.
+func addFromFile(path string, add func(r io.Reader) (*sbrdata.ImportResult, error), results map[string]*sbrdata.ImportResult) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	result, err := add(bufio.NewReader(f))
+	results[path] = result
+	return err
+}
+
+// printSummary prints a table of the import results per file and collection key to stdout.
+// An error is returned if any record failed to import.
+func printSummary(results map[string]*sbrdata.ImportResult) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "file\tkey\tadded\tduplicate\tupdated\tfailed\tquarantined\t")
+	files := make([]string, 0, len(results))
+	for file := range results {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	failed := 0
+	for _, file := range files {
+		result := results[file]
+		for _, key := range result.SortedKeys() {
+			c := result.Keys[key]
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t\n", file, key, c.Added, c.Duplicate, c.Updated, c.Failed, c.Quarantined)
+		}
+		for _, record := range result.Failed {
+			log.Printf("failed to import %s for %q: %s", record.Kind, record.Key, record.Reason)
+		}
+		failed += len(result.Failed)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d records failed to import", failed)
 	}
-	return gc.Save()
+	return nil
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+
+	"github.com/sascha-andres/sbrdata/v2"
+
+	"github.com/sascha-andres/reuse/flag"
+)
+
+var (
+	baseDirectory, sqliteFile string
+	passphrase, keyFile       string
+	verbose                   bool
+)
+
+// main is the entry point of the program.
+// It sets the prefix and flags for the logger, parses the command-line flags,
+// and calls the run function to perform the export.
+// If there is an error returned by run, it logs a fatal error and terminates the program.
+func main() {
+	log.SetPrefix("[SBR_EXPORT_SQLITE_V2] ")
+	log.SetFlags(log.LstdFlags | log.LUTC | log.Lshortfile)
+
+	flag.SetEnvPrefix("SBR_EXPORT_SQLITE_V2")
+	flag.StringVar(&baseDirectory, "base-directory", "", "pass path of data directory")
+	flag.StringVarWithoutEnv(&sqliteFile, "sqlite-file", "", "pass name/path of SQLite database file to create")
+	flag.StringVar(&passphrase, "passphrase", "", "passphrase the data directory is encrypted with; prefer the environment variable")
+	flag.StringVar(&keyFile, "key-file", "", "key file the data directory is encrypted with instead of a passphrase")
+	flag.BoolVarWithoutEnv(&verbose, "verbose", false, "print more information")
+	flag.Parse()
+
+	err := run()
+	if err != nil {
+		log.Fatalf("error running export: %s", err)
+	}
+}
+
+// run writes the data directory into a new SQLite database file
+func run() error {
+	if baseDirectory == "" {
+		return errors.New("you have to provide base directory")
+	}
+	// reading must not create a mistyped data directory
+	if _, err := os.Stat(baseDirectory); err != nil {
+		return err
+	}
+	if sqliteFile == "" {
+		return errors.New("you have to provide SQLite file")
+	}
+
+	opts := []sbrdata.GroupedCollectionOption{
+		sbrdata.SetBaseDirectory(baseDirectory),
+	}
+	if verbose {
+		opts = append(opts, sbrdata.SetVerbose())
+	}
+	key, err := sbrdata.NewEncryptionKey(passphrase, keyFile)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, sbrdata.SetEncryptionKey(key))
+	gc, err := sbrdata.NewGroupedCollection(opts...)
+	if err != nil {
+		return err
+	}
+	err = sbrdata.ExportSQLite(gc, sqliteFile)
+	if err != nil {
+		return err
+	}
+	log.Printf("exported %q to %q", baseDirectory, sqliteFile)
+	return nil
+}
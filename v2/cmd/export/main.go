@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+
+	"github.com/sascha-andres/sbrdata/v2"
+
+	"github.com/sascha-andres/reuse/flag"
+)
+
+var (
+	baseDirectory, sqliteFile, filter string
+	callFile, messageFile, timezone   string
+	passphrase, keyFile               string
+	verbose, includeQuarantined       bool
+)
+
+// main is the entry point of the program.
+// It sets the prefix and flags for the logger, parses the command-line flags,
+// and calls the run function to perform the export.
+// If there is an error returned by run, it logs a fatal error and terminates the program.
+func main() {
+	log.SetPrefix("[SBR_EXPORT_V2] ")
+	log.SetFlags(log.LstdFlags | log.LUTC | log.Lshortfile)
+
+	flag.SetEnvPrefix("SBR_EXPORT_V2")
+	flag.StringVar(&baseDirectory, "base-directory", "", "pass path of data directory")
+	flag.StringVar(&sqliteFile, "sqlite-file", "", "use the SQLite database file as archive instead of the data directory")
+	flag.StringVarWithoutEnv(&messageFile, "message-file", "", "pass name/path of message file to write")
+	flag.StringVarWithoutEnv(&callFile, "call-file", "", "pass name/path of call file to write")
+	flag.StringVarWithoutEnv(&filter, "filter", "", "filter expression selecting the records to export, e.g. 'after:2023-01-01 before:2024-01-01 (name:alice OR number:+49171)'")
+	flag.BoolVarWithoutEnv(&includeQuarantined, "include-quarantined", false, "export records with unparsable dates from unparsed.json as well, after all other records")
+	flag.StringVar(&timezone, "timezone", "", "time zone of the base directory, defaults to the one recorded in it")
+	flag.StringVar(&passphrase, "passphrase", "", "passphrase the data directory is encrypted with; prefer the environment variable")
+	flag.StringVar(&keyFile, "key-file", "", "key file the data directory is encrypted with instead of a passphrase")
+	flag.BoolVarWithoutEnv(&verbose, "verbose", false, "print more information")
+	flag.Parse()
+
+	err := run()
+	if err != nil {
+		log.Fatalf("error running export: %s", err)
+	}
+}
+
+// run writes the messages and calls matching the filter as SMS Backup & Restore exports
+func run() error {
+	if baseDirectory == "" && sqliteFile == "" {
+		return errors.New("you have to provide base directory")
+	}
+	if messageFile == "" && callFile == "" {
+		return errors.New("you have to provide message file or call file")
+	}
+	opts := make([]sbrdata.GroupedCollectionOption, 1)
+	archive := baseDirectory
+	if sqliteFile != "" {
+		archive = sqliteFile
+	}
+	// reading must not create a mistyped data directory or database
+	if _, err := os.Stat(archive); err != nil {
+		return err
+	}
+	if sqliteFile != "" {
+		store, err := sbrdata.NewSQLiteStore(sqliteFile)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		opts[0] = sbrdata.SetStore(store)
+	} else {
+		opts[0] = sbrdata.SetBaseDirectory(baseDirectory)
+	}
+	if verbose {
+		opts = append(opts, sbrdata.SetVerbose())
+	}
+	if timezone != "" {
+		opts = append(opts, sbrdata.SetTimezone(timezone))
+	}
+	key, err := sbrdata.NewEncryptionKey(passphrase, keyFile)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, sbrdata.SetEncryptionKey(key))
+	gc, err := sbrdata.NewGroupedCollection(opts...)
+	if err != nil {
+		return err
+	}
+	f, err := sbrdata.ParseFilterInLocation(filter, gc.Location())
+	if err != nil {
+		return err
+	}
+	exportOpts := sbrdata.ExportOptions{Filter: f, Quarantined: includeQuarantined}
+	if messageFile != "" {
+		result, err := sbrdata.ExportMessages(gc, messageFile, exportOpts)
+		if err != nil {
+			return err
+		}
+		log.Printf("exported %d messages to %q", result.Records, messageFile)
+		logQuarantined(result)
+	}
+	if callFile != "" {
+		result, err := sbrdata.ExportCalls(gc, callFile, exportOpts)
+		if err != nil {
+			return err
+		}
+		log.Printf("exported %d calls to %q", result.Records, callFile)
+		logQuarantined(result)
+	}
+	return nil
+}
+
+// logQuarantined reports quarantined records left out of an export
+func logQuarantined(result sbrdata.ExportResult) {
+	if result.Quarantined > 0 && !includeQuarantined {
+		log.Printf("left out %d quarantined records with unparsable dates, use -include-quarantined to export them", result.Quarantined)
+	}
+}
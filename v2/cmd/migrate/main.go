@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/sascha-andres/sbrdata/v2"
+
+	"github.com/sascha-andres/reuse/flag"
+)
+
+var (
+	baseDirectory, collectionFile, timezone string
+	verbose                                 bool
+	groupPeriod                             uint
+)
+
+// main is the entry point of the program.
+// It sets the prefix and flags for the logger, parses the command-line flags,
+// and calls the run function to perform the migration.
+// If there is an error returned by run, it logs a fatal error and terminates the program.
+func main() {
+	log.SetPrefix("[SBR_MIGRATE_V2] ")
+	log.SetFlags(log.LstdFlags | log.LUTC | log.Lshortfile)
+
+	flag.SetEnvPrefix("SBR_MIGRATE_V2")
+	flag.StringVarWithoutEnv(&collectionFile, "collection-file", "", "pass name/path of v1 collection file")
+	flag.StringVar(&baseDirectory, "base-directory", "", "pass path of data directory to create")
+	flag.UintVar(&groupPeriod, "group-period", 99, "use 0 for no grouping, 1 for monthly, 2 for yearly, 3 for daily, 4 for weekly (ISO), 5 for quarterly and 6 by counterpart")
+	flag.StringVar(&timezone, "timezone", "", "time zone to group records in, e.g. UTC or Europe/Berlin; defaults to the local one")
+	flag.BoolVarWithoutEnv(&verbose, "verbose", false, "print more information")
+	flag.Parse()
+
+	err := run()
+	if err != nil {
+		log.Fatalf("error running migration: %s", err)
+	}
+}
+
+// run writes the v1 collection file into a new grouped data directory
+func run() error {
+	if collectionFile == "" {
+		return errors.New("you have to provide collection file")
+	}
+	if baseDirectory == "" {
+		return errors.New("you have to provide base directory")
+	}
+	if groupPeriod == 99 {
+		return errors.New("you have to provide group period")
+	}
+
+	opts := []sbrdata.GroupedCollectionOption{
+		sbrdata.SetBaseDirectory(baseDirectory),
+		sbrdata.SetGroupPeriod(sbrdata.GroupPeriod(groupPeriod)),
+	}
+	if timezone != "" {
+		opts = append(opts, sbrdata.SetTimezone(timezone))
+	}
+	if verbose {
+		opts = append(opts, sbrdata.SetVerbose())
+	}
+	err := sbrdata.MigrateV1(collectionFile, opts...)
+	if err != nil {
+		return err
+	}
+	log.Printf("migrated %q to %q", collectionFile, baseDirectory)
+	return nil
+}
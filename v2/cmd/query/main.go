@@ -1,53 +1,103 @@
-//package main
-//
-//import (
-//	"errors"
-//	"github.com/sascha-andres/sbrdata"
-//	"log"
-//	"strings"
-//
-//	"github.com/sascha-andres/reuse/flag"
-//)
-//
-//var (
-//	collectionFile, number, name string
-//)
-//
-//func init() {
-//	log.SetPrefix("[SBR_QUERY] ")
-//	log.SetFlags(log.LstdFlags | log.LUTC | log.Lshortfile)
-//
-//	flag.SetEnvPrefix("SBR_QUERY")
-//	flag.StringVar(&collectionFile, "collection-file", "", "pass name/path of collection file")
-//	flag.StringVar(&number, "number", "", "pass number to query")
-//	flag.StringVar(&name, "name", "", "pass name to query")
-//}
-//
-//func main() {
-//	flag.Parse()
-//
-//	err := run()
-//	if err != nil {
-//		log.Fatalf("error running query: %s", err)
-//	}
-//}
-//
-//func run() error {
-//	if collectionFile == "" {
-//		return errors.New("you have to provide collection file")
-//	}
-//	if number == "" && name == "" {
-//		return errors.New("you have to provide either number or name")
-//	}
-//
-//	c, err := sbrdata.LoadCollection(collectionFile)
-//	if err != nil {
-//		return err
-//	}
-//	for i := range c.Calls {
-//		if strings.Contains(c.Calls[i].Number, number) || strings.Contains(c.Calls[i].ContactName, name) {
-//			log.Printf("Call: %v", c.Calls[i])
-//		}
-//	}
-//	return nil
-//}
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/sascha-andres/sbrdata/v2"
+
+	"github.com/sascha-andres/reuse/flag"
+)
+
+var (
+	baseDirectory, filter, timezone string
+	sqliteFile, passphrase, keyFile string
+	verbose                         bool
+	groupPeriod                     uint
+)
+
+// main is the entry point of the program.
+// It sets the prefix and flags for the logger, parses the command-line flags,
+// and calls the run function to perform the query.
+// If there is an error returned by run, it logs a fatal error and terminates the program.
+func main() {
+	log.SetPrefix("[SBR_QUERY_V2] ")
+	log.SetFlags(log.LstdFlags | log.LUTC | log.Lshortfile)
+
+	flag.SetEnvPrefix("SBR_QUERY_V2")
+	flag.StringVar(&baseDirectory, "base-directory", "", "pass path of data directory")
+	flag.StringVar(&sqliteFile, "sqlite-file", "", "use the SQLite database file as archive instead of the data directory")
+	flag.UintVar(&groupPeriod, "group-period", 99, "use 0 for no grouping, 1 for monthly, 2 for yearly, 3 for daily, 4 for weekly (ISO), 5 for quarterly and 6 by counterpart; defaults to the one recorded in the data directory")
+	flag.StringVarWithoutEnv(&filter, "filter", "", "filter expression, e.g. 'kind:sms AND (name:alice OR number:+49171) after:2023-01-01'")
+	flag.StringVar(&timezone, "timezone", "", "time zone of the base directory, defaults to the one recorded in it")
+	flag.StringVar(&passphrase, "passphrase", "", "passphrase the data directory is encrypted with; prefer the environment variable")
+	flag.StringVar(&keyFile, "key-file", "", "key file the data directory is encrypted with instead of a passphrase")
+	flag.BoolVarWithoutEnv(&verbose, "verbose", false, "print more information")
+	flag.Parse()
+
+	err := run()
+	if err != nil {
+		log.Fatalf("error running query: %s", err)
+	}
+}
+
+// run opens the grouped collection in baseDirectory, iterates over the collections overlapping the
+// date range of the filter and prints all calls and messages matching the filter in chronological order.
+func run() error {
+	if baseDirectory == "" && sqliteFile == "" {
+		return errors.New("you have to provide base directory")
+	}
+	opts := make([]sbrdata.GroupedCollectionOption, 1)
+	archive := baseDirectory
+	if sqliteFile != "" {
+		archive = sqliteFile
+	}
+	// reading must not create a mistyped data directory or database
+	if _, err := os.Stat(archive); err != nil {
+		return err
+	}
+	if sqliteFile != "" {
+		store, err := sbrdata.NewSQLiteStore(sqliteFile)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		opts[0] = sbrdata.SetStore(store)
+	} else {
+		opts[0] = sbrdata.SetBaseDirectory(baseDirectory)
+	}
+	if groupPeriod != 99 {
+		opts = append(opts, sbrdata.SetGroupPeriod(sbrdata.GroupPeriod(groupPeriod)))
+	}
+	if verbose {
+		opts = append(opts, sbrdata.SetVerbose())
+	}
+	if timezone != "" {
+		opts = append(opts, sbrdata.SetTimezone(timezone))
+	}
+	key, err := sbrdata.NewEncryptionKey(passphrase, keyFile)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, sbrdata.SetEncryptionKey(key))
+	gc, err := sbrdata.NewGroupedCollection(opts...)
+	if err != nil {
+		return err
+	}
+	f, err := sbrdata.ParseFilterInLocation(filter, gc.Location())
+	if err != nil {
+		return err
+	}
+
+	for e, err := range gc.IterEventsBetween(f.Range()) {
+		if err != nil {
+			return err
+		}
+		if f.MatchEvent(e) {
+			fmt.Println(e)
+		}
+	}
+	return nil
+}
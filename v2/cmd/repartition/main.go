@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/sascha-andres/sbrdata/v2"
+
+	"github.com/sascha-andres/reuse/flag"
+)
+
+var (
+	baseDirectory, collectionFile, timezone string
+	compression, passphrase, keyFile        string
+	verbose                                 bool
+	groupPeriod, targetPeriod               uint
+)
+
+// main is the entry point of the program.
+// It sets the prefix and flags for the logger, parses the command-line flags,
+// and calls the run function to perform the repartitioning.
+// If there is an error returned by run, it logs a fatal error and terminates the program.
+func main() {
+	log.SetPrefix("[SBR_REPARTITION_V2] ")
+	log.SetFlags(log.LstdFlags | log.LUTC | log.Lshortfile)
+
+	flag.SetEnvPrefix("SBR_REPARTITION_V2")
+	flag.StringVar(&baseDirectory, "base-directory", "", "pass path of data directory")
+	flag.UintVar(&groupPeriod, "group-period", 99, "current grouping: use 0 for no grouping, 1 for monthly, 2 for yearly, 3 for daily, 4 for weekly (ISO), 5 for quarterly and 6 by counterpart; defaults to the one recorded in the data directory")
+	flag.UintVar(&targetPeriod, "target-period", 99, "grouping to rewrite the data directory with, same values as group-period")
+	flag.StringVarWithoutEnv(&collectionFile, "collection-file", "", "read a single collection file, e.g. of v1, instead of the data directory, which must not exist yet")
+	flag.StringVar(&timezone, "timezone", "", "time zone to group records in, defaults to the one recorded in the data directory")
+	flag.StringVar(&compression, "compression", sbrdata.CompressionNameNone, "compression of the collection files written: none, gzip or zstd")
+	flag.StringVar(&passphrase, "passphrase", "", "passphrase the data directory is encrypted with; prefer the environment variable")
+	flag.StringVar(&keyFile, "key-file", "", "key file the data directory is encrypted with instead of a passphrase")
+	flag.BoolVarWithoutEnv(&verbose, "verbose", false, "print more information")
+	flag.Parse()
+
+	err := run()
+	if err != nil {
+		log.Fatalf("error running repartition: %s", err)
+	}
+}
+
+// run rewrites the data directory using the target period. If a collection file is given, it is
+// used as source for a new data directory instead.
+func run() error {
+	if baseDirectory == "" {
+		return errors.New("you have to provide base directory")
+	}
+	if targetPeriod == 99 {
+		return errors.New("you have to provide target period")
+	}
+	c, err := sbrdata.CompressionByName(compression)
+	if err != nil {
+		return err
+	}
+	key, err := sbrdata.NewEncryptionKey(passphrase, keyFile)
+	if err != nil {
+		return err
+	}
+
+	if collectionFile != "" {
+		opts := []sbrdata.GroupedCollectionOption{
+			sbrdata.SetBaseDirectory(baseDirectory),
+			sbrdata.SetGroupPeriod(sbrdata.GroupPeriod(targetPeriod)),
+			sbrdata.SetCompression(c),
+			sbrdata.SetEncryptionKey(key),
+		}
+		if timezone != "" {
+			opts = append(opts, sbrdata.SetTimezone(timezone))
+		}
+		if verbose {
+			opts = append(opts, sbrdata.SetVerbose())
+		}
+		err = sbrdata.RepartitionFile(collectionFile, opts...)
+		if err != nil {
+			return err
+		}
+		log.Printf("wrote %q to %q", collectionFile, baseDirectory)
+		return nil
+	}
+
+	opts := []sbrdata.GroupedCollectionOption{
+		sbrdata.SetBaseDirectory(baseDirectory),
+		sbrdata.SetCompression(c),
+		sbrdata.SetEncryptionKey(key),
+	}
+	if groupPeriod != 99 {
+		opts = append(opts, sbrdata.SetGroupPeriod(sbrdata.GroupPeriod(groupPeriod)))
+	}
+	if timezone != "" {
+		opts = append(opts, sbrdata.SetTimezone(timezone))
+	}
+	if verbose {
+		opts = append(opts, sbrdata.SetVerbose())
+	}
+	gc, err := sbrdata.NewGroupedCollection(opts...)
+	if err != nil {
+		return err
+	}
+	old, err := sbrdata.Repartition(gc, sbrdata.GroupPeriod(targetPeriod))
+	if err != nil {
+		return err
+	}
+	log.Printf("repartitioned %q, the old data directory including backups is kept as %q", baseDirectory, old)
+	return nil
+}
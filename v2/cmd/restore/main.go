@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+
+	"github.com/sascha-andres/sbrdata/v2"
+
+	"github.com/sascha-andres/reuse/flag"
+)
+
+var (
+	baseDirectory, key, backup string
+	passphrase, keyFile        string
+	verbose                    bool
+	keepLast, keepDaily        uint
+	keepWeekly, keepMonthly    uint
+)
+
+// main is the entry point of the program.
+// It sets the prefix and flags for the logger, parses the command-line flags,
+// and calls the run function to restore the backup.
+// If there is an error returned by run, it logs a fatal error and terminates the program.
+func main() {
+	log.SetPrefix("[SBR_RESTORE_V2] ")
+	log.SetFlags(log.LstdFlags | log.LUTC | log.Lshortfile)
+
+	flag.SetEnvPrefix("SBR_RESTORE_V2")
+	flag.StringVar(&baseDirectory, "base-directory", "", "pass path of data directory")
+	flag.StringVarWithoutEnv(&key, "key", "", "key of the collection to restore, e.g. 2023/05 when grouped monthly or 2023 when grouped yearly; leave empty without grouping")
+	flag.StringVarWithoutEnv(&backup, "backup", "", "name of the backup to restore as listed by the backups command")
+	flag.StringVar(&passphrase, "passphrase", "", "passphrase the data directory is encrypted with; prefer the environment variable")
+	flag.StringVar(&keyFile, "key-file", "", "key file the data directory is encrypted with instead of a passphrase")
+	flag.UintVar(&keepLast, "keep-last", 0, "keep the most recent backups of each file, 0 keeps all unless another keep flag is used")
+	flag.UintVar(&keepDaily, "keep-daily", 0, "keep the most recent backup of each of the given number of days")
+	flag.UintVar(&keepWeekly, "keep-weekly", 0, "keep the most recent backup of each of the given number of weeks")
+	flag.UintVar(&keepMonthly, "keep-monthly", 0, "keep the most recent backup of each of the given number of months")
+	flag.BoolVarWithoutEnv(&verbose, "verbose", false, "print more information")
+	flag.Parse()
+
+	err := run()
+	if err != nil {
+		log.Fatalf("error running restore: %s", err)
+	}
+}
+
+// run replaces the collection with key by the backup, keeping the current file as backup
+func run() error {
+	if baseDirectory == "" {
+		return errors.New("you have to provide base directory")
+	}
+	// reading must not create a mistyped data directory
+	if _, err := os.Stat(baseDirectory); err != nil {
+		return err
+	}
+	if backup == "" {
+		return errors.New("you have to provide the backup to restore")
+	}
+	opts := []sbrdata.GroupedCollectionOption{
+		sbrdata.SetBaseDirectory(baseDirectory),
+		sbrdata.SetBackupRetention(sbrdata.BackupRetention{
+			Last:    int(keepLast),
+			Daily:   int(keepDaily),
+			Weekly:  int(keepWeekly),
+			Monthly: int(keepMonthly),
+		}),
+	}
+	if verbose {
+		opts = append(opts, sbrdata.SetVerbose())
+	}
+	encryptionKey, err := sbrdata.NewEncryptionKey(passphrase, keyFile)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, sbrdata.SetEncryptionKey(encryptionKey))
+	gc, err := sbrdata.NewGroupedCollection(opts...)
+	if err != nil {
+		return err
+	}
+	err = gc.RestoreBackup(key, backup)
+	if err != nil {
+		return err
+	}
+	log.Printf("restored %q from %q", key, backup)
+	return nil
+}
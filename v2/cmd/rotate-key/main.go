@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+
+	"github.com/sascha-andres/sbrdata/v2"
+
+	"github.com/sascha-andres/reuse/flag"
+)
+
+var (
+	baseDirectory, passphrase, keyFile string
+	newPassphrase, newKeyFile          string
+	verbose, decrypt                   bool
+)
+
+// main is the entry point of the program.
+// It sets the prefix and flags for the logger, parses the command-line flags,
+// and calls the run function to perform the key rotation.
+// If there is an error returned by run, it logs a fatal error and terminates the program.
+func main() {
+	log.SetPrefix("[SBR_ROTATE_KEY_V2] ")
+	log.SetFlags(log.LstdFlags | log.LUTC | log.Lshortfile)
+
+	flag.SetEnvPrefix("SBR_ROTATE_KEY_V2")
+	flag.StringVar(&baseDirectory, "base-directory", "", "pass path of data directory")
+	flag.StringVar(&passphrase, "passphrase", "", "current passphrase, leave empty if the data directory is not encrypted yet; prefer the environment variable")
+	flag.StringVar(&keyFile, "key-file", "", "current key file instead of a passphrase")
+	flag.StringVar(&newPassphrase, "new-passphrase", "", "passphrase to encrypt the data directory with; prefer the environment variable")
+	flag.StringVar(&newKeyFile, "new-key-file", "", "key file to encrypt the data directory with instead of a passphrase")
+	flag.BoolVarWithoutEnv(&decrypt, "decrypt", false, "remove the encryption instead of using a new key")
+	flag.BoolVarWithoutEnv(&verbose, "verbose", false, "print more information")
+	flag.Parse()
+
+	err := run()
+	if err != nil {
+		log.Fatalf("error running key rotation: %s", err)
+	}
+}
+
+// run re-encrypts the data directory using the new key
+func run() error {
+	if baseDirectory == "" {
+		return errors.New("you have to provide base directory")
+	}
+	// reading must not create a mistyped data directory
+	if _, err := os.Stat(baseDirectory); err != nil {
+		return err
+	}
+	key, err := sbrdata.NewEncryptionKey(passphrase, keyFile)
+	if err != nil {
+		return err
+	}
+	newKey, err := sbrdata.NewEncryptionKey(newPassphrase, newKeyFile)
+	if err != nil {
+		return err
+	}
+	if newKey == nil && !decrypt {
+		return errors.New("you have to provide a new passphrase or key file")
+	}
+	if newKey != nil && decrypt {
+		return errors.New("a new key cannot be used when decrypting")
+	}
+
+	opts := []sbrdata.GroupedCollectionOption{
+		sbrdata.SetBaseDirectory(baseDirectory),
+		sbrdata.SetEncryptionKey(key),
+	}
+	if verbose {
+		opts = append(opts, sbrdata.SetVerbose())
+	}
+	gc, err := sbrdata.NewGroupedCollection(opts...)
+	if err != nil {
+		return err
+	}
+	err = sbrdata.RotateKey(gc, newKey)
+	if err != nil {
+		return err
+	}
+	log.Printf("re-encrypted %q", baseDirectory)
+	return nil
+}
@@ -7,11 +7,8 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"time"
 
 	"github.com/sascha-andres/reuse/functional"
-
-	"golang.org/x/exp/slices"
 )
 
 // Collection is a container for all calls/messages that can be filled delta like
@@ -28,17 +25,61 @@ type Collection struct {
 	verbose bool
 	// backup controls whether a backup file is created
 	backup bool
+	// retention decides which backups are kept
+	retention BackupRetention
+	// identity computes the keys used to detect known records
+	identity KeyFuncs
+	// merge controls whether known records are updated with data from added records
+	merge MergeMode
+	// changes holds all fields updated by merging
+	changes []FieldChange
+	// index maps record identities to their position, built lazily on first lookup
+	index *recordIndex
+	// dirty is true if records were added or updated since loading or saving
+	dirty bool
+	// key encrypts the collection file on save, nil to write it unencrypted
+	key *EncryptionKey
+}
+
+// recordIndex allows constant time lookup of known records
+type recordIndex struct {
+	calls map[string]int
+	sms   map[string]int
+	mms   map[string]int
+	// indexed holds the number of calls, sms and mms covered by the index
+	indexed [3]int
 }
 
-// LoadCollection loads a collection of communication data from a file
+// LoadCollection loads a collection of communication data from a file.
+// Collections written by the v1 package are upgraded, they are persisted in the current format when saved.
+// Compressed files are detected by their content, encrypted files are refused with ErrEncrypted.
 func LoadCollection(path string) (*Collection, error) {
-	data, err := os.ReadFile(path)
+	return loadCollection(path, nil, false)
+}
+
+// LoadEncryptedCollection loads a collection from a file encrypted using key, plain files are read as well.
+// The collection is encrypted using key when saved.
+func LoadEncryptedCollection(path string, key *EncryptionKey) (*Collection, error) {
+	c, err := loadCollection(path, key, false)
 	if err != nil {
 		return nil, err
 	}
-	var coll Collection
-	err = json.Unmarshal(data, &coll)
-	return &coll, err
+	c.SetEncryptionKey(key)
+	return c, nil
+}
+
+// loadCollection loads a collection from a file, decrypting it using key if required. Unencrypted files are refused
+// if encryptedOnly is set.
+func loadCollection(path string, key *EncryptionKey, encryptedOnly bool) (*Collection, error) {
+	data, err := readCollectionFile(path, key, encryptedOnly)
+	if err != nil {
+		return nil, err
+	}
+	coll, _, err := decodeCollection(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not load %q: %w", path, err)
+	}
+	return coll, nil
 }
 
 // KeyFuncs is a container for all key functions
@@ -100,38 +141,51 @@ func LoadGroupedCollection(path string, key KeyFuncs) (map[string]*Collection, e
 	return result, nil
 }
 
-// Save will store all data in the collection
+// Save will store all data in the collection. The file is compressed if path ends in .gz or .zst and
+// encrypted if a key was set using SetEncryptionKey.
 func (c *Collection) Save(path string) error {
-	data, err := json.MarshalIndent(c, "", "  ")
+	if c.backup {
+		tx := newTransaction(filepath.Dir(path))
+		if err := c.doBackup(tx, path); err != nil {
+			tx.abort()
+			return err
+		}
+		if err := tx.commit(); err != nil {
+			return err
+		}
+	}
+	data, err := c.marshal(compressionOf(path), c.key)
 	if err != nil {
 		return err
 	}
+	if err = writeFileAtomic(path, data, 0600); err != nil {
+		return err
+	}
+	c.dirty = false
 	if c.backup {
-		err = c.doBackup(path)
-		if err != nil {
-			return err
-		}
+		return pruneBackups(path, c.retention)
 	}
-	return os.WriteFile(path, data, 0600)
+	return nil
 }
 
-// doBackup creates a backup of the collection. file.ext => file.timestamp.ext
-func (c *Collection) doBackup(path string) error {
-	fs, err := os.Stat(path)
-	if err == nil {
-		base := filepath.Dir(path)
-		ext := filepath.Ext(path)
-		name := fs.Name()
-		if ext != "" {
-			name = name[:len(name)-len(ext)]
-		}
-		dest := fmt.Sprintf("%s/%s.%d%s", base, name, time.Now().Unix(), ext)
-		err = copy(path, dest, 1024)
-		if err != nil {
-			return err
-		}
+// marshal returns the JSON to persist the collection, compressed using compression and encrypted using key
+func (c *Collection) marshal(compression Compression, key *EncryptionKey) ([]byte, error) {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	data, err = compress(data, compression)
+	if err != nil {
+		return nil, err
+	}
+	return seal(data, key)
+}
+
+// doBackup stages a backup of the collection file at path as part of tx. file.ext => file.timestamp.ext,
+// compressed files keep their extension, e.g. file.timestamp.json.gz. See pruneBackups for removing the
+// backups not kept by the retention once tx is committed.
+func (c *Collection) doBackup(tx *transaction, path string) error {
+	return stageBackup(tx, path)
 }
 
 // AddCalls will add all calls to collection which are not yet known.
@@ -139,22 +193,46 @@ func (c *Collection) AddCalls(calls CallsData) error {
 	return c.addCalls(calls.GetCalls()...)
 }
 
-// AddCalls will add all calls to collection which are not yet known
+// AddCalls will add all calls to collection which are not yet known, known calls are merged according to SetMerge
 func (c *Collection) addCalls(calls ...Call) error {
 	for _, call := range calls {
-		if !c.isKnownCall(call) {
-			if c.verbose {
-				log.Printf("adding call with %q on %q", call.GetContactName(), call.GetDate())
-			}
-			c.Calls = append(c.Calls, call)
+		if _, err := c.insertCall(call); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-// isKnownCall returns true if call is already in collection
-func (c *Collection) isKnownCall(call Call) bool {
-	return slices.Contains(c.Calls, call)
+// insertCall adds call if not yet known or merges it into the known call and reports what happened
+func (c *Collection) insertCall(call Call) (recordOutcome, error) {
+	key, known, err := c.isKnownCall(call)
+	if err != nil {
+		return recordDuplicate, err
+	}
+	if known {
+		return mergeOutcome(c.mergeCall(key, call))
+	}
+	if c.verbose {
+		log.Printf("adding call with %q on %q", call.GetContactName(), call.GetDate())
+	}
+	c.index.calls[key] = len(c.Calls)
+	c.Calls = append(c.Calls, call)
+	c.index.indexed[0]++
+	c.dirty = true
+	return recordAdded, nil
+}
+
+// isKnownCall returns the identity of call and true if call is already in collection
+func (c *Collection) isKnownCall(call Call) (string, bool, error) {
+	if err := c.ensureIndex(); err != nil {
+		return "", false, err
+	}
+	key, err := c.identity.Call(call)
+	if err != nil {
+		return "", false, err
+	}
+	_, ok := c.index.calls[key]
+	return key, ok, nil
 }
 
 // AddMessages will add SMS and MMS messages to the collection by calling the respective methods AddSms and AddMms.
@@ -171,46 +249,141 @@ func (c *Collection) AddMessages(messages MessageData) error {
 }
 
 // AddSms will add SMS messages to the collection if they are not already known.
+// Known messages are merged according to SetMerge.
 // If the verbose flag is set, a log message will be printed.
 func (c *Collection) AddSms(messages ...SMS) error {
 	for _, s := range messages {
-		if !c.isKnownSMS(s) {
-			if c.verbose {
-				log.Printf("adding sms mms %q on %q", s.GetContactName(), s.GetDate())
-			}
-			c.Sms = append(c.Sms, s)
+		if _, err := c.insertSms(s); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// insertSms adds s if not yet known or merges it into the known SMS and reports what happened
+func (c *Collection) insertSms(s SMS) (recordOutcome, error) {
+	key, known, err := c.isKnownSMS(s)
+	if err != nil {
+		return recordDuplicate, err
+	}
+	if known {
+		return mergeOutcome(c.mergeSms(key, s))
+	}
+	if c.verbose {
+		log.Printf("adding sms mms %q on %q", s.GetContactName(), s.GetDate())
+	}
+	c.index.sms[key] = len(c.Sms)
+	c.Sms = append(c.Sms, s)
+	c.index.indexed[1]++
+	c.dirty = true
+	return recordAdded, nil
+}
+
 // AddMms will add MMS messages to the collection if they are not already known.
+// Known messages are merged according to SetMerge.
 // If the verbose flag is set, a log message will be printed.
 func (c *Collection) AddMms(messages ...MMS) error {
-	for _, s := range messages {
-		if !c.isKnownMMS(s) {
-			if c.verbose {
-				log.Printf("adding sms mms %q on %q", s.GetContactName(), s.GetDate())
-			}
-			c.Mms = append(c.Mms, s)
+	for _, m := range messages {
+		if _, err := c.insertMms(m); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-// isKnownSMS scans collection for SMS and returns true if found
-func (c *Collection) isKnownSMS(sms SMS) bool {
-	return slices.Contains(c.Sms, sms)
+// insertMms adds m if not yet known or merges it into the known MMS and reports what happened
+func (c *Collection) insertMms(m MMS) (recordOutcome, error) {
+	key, known, err := c.isKnownMMS(m)
+	if err != nil {
+		return recordDuplicate, err
+	}
+	if known {
+		return mergeOutcome(c.mergeMms(key, m))
+	}
+	if c.verbose {
+		log.Printf("adding sms mms %q on %q", m.GetContactName(), m.GetDate())
+	}
+	c.index.mms[key] = len(c.Mms)
+	c.Mms = append(c.Mms, m)
+	c.index.indexed[2]++
+	c.dirty = true
+	return recordAdded, nil
+}
+
+// mergeOutcome turns the result of merging into the outcome of adding a known record
+func mergeOutcome(changed int, err error) (recordOutcome, error) {
+	if err != nil || changed == 0 {
+		return recordDuplicate, err
+	}
+	return recordUpdated, nil
+}
+
+// isKnownSMS returns the identity of sms and true if it is already in collection
+func (c *Collection) isKnownSMS(sms SMS) (string, bool, error) {
+	if err := c.ensureIndex(); err != nil {
+		return "", false, err
+	}
+	key, err := c.identity.SMS(sms)
+	if err != nil {
+		return "", false, err
+	}
+	_, ok := c.index.sms[key]
+	return key, ok, nil
+}
+
+// isKnownMMS returns the identity of m and true if it is already in collection
+func (c *Collection) isKnownMMS(m MMS) (string, bool, error) {
+	if err := c.ensureIndex(); err != nil {
+		return "", false, err
+	}
+	key, err := c.identity.MMS(m)
+	if err != nil {
+		return "", false, err
+	}
+	_, ok := c.index.mms[key]
+	return key, ok, nil
 }
 
-// isKnownMMS scans collection for MMS and returns true if found
-func (c *Collection) isKnownMMS(m MMSData) bool {
-	for _, s := range c.Mms {
-		if s.Date == m.GetDate() && s.Address == m.GetAddress() {
-			return true
+// ensureIndex builds the index from the record slices if it does not exist yet or
+// if the slices were modified without going through the Add methods
+func (c *Collection) ensureIndex() error {
+	if c.index != nil && c.index.indexed == [3]int{len(c.Calls), len(c.Sms), len(c.Mms)} {
+		return nil
+	}
+	identity, err := effectiveIdentity(c.identity, c.merge)
+	if err != nil {
+		return err
+	}
+	c.identity = identity
+	index := &recordIndex{
+		calls: make(map[string]int, len(c.Calls)),
+		sms:   make(map[string]int, len(c.Sms)),
+		mms:   make(map[string]int, len(c.Mms)),
+	}
+	for i, call := range c.Calls {
+		key, err := c.identity.Call(call)
+		if err != nil {
+			return err
+		}
+		index.calls[key] = i
+	}
+	for i, s := range c.Sms {
+		key, err := c.identity.SMS(s)
+		if err != nil {
+			return err
+		}
+		index.sms[key] = i
+	}
+	for i, m := range c.Mms {
+		key, err := c.identity.MMS(m)
+		if err != nil {
+			return err
 		}
+		index.mms[key] = i
 	}
-	return false
+	index.indexed = [3]int{len(c.Calls), len(c.Sms), len(c.Mms)}
+	c.index = index
+	return nil
 }
 
 // SetVerbose is used to make collection a bit more heavy on informational output
@@ -218,11 +391,40 @@ func (c *Collection) SetVerbose() {
 	c.verbose = true
 }
 
+// SetIdentity replaces the key functions used to detect already known records.
+// Incomplete key functions fall back to StrictIdentity, or ContentIdentity when merging.
+func (c *Collection) SetIdentity(identity KeyFuncs) {
+	c.identity = identity
+	c.index = nil
+}
+
+// SetMerge controls whether known records are updated with the data of records added again.
+// Merging does not work with StrictIdentity, see SetIdentity.
+func (c *Collection) SetMerge(mode MergeMode) {
+	c.merge = mode
+	c.index = nil
+}
+
+// Changes returns all fields updated by merging known records since the collection was loaded
+func (c *Collection) Changes() []FieldChange {
+	return c.changes
+}
+
+// SetEncryptionKey tells collection to encrypt the file on save using key, nil to write it unencrypted
+func (c *Collection) SetEncryptionKey(key *EncryptionKey) {
+	c.key = key
+}
+
 // SetBackup tells collection to make a backup on save
 func (c *Collection) SetBackup() {
 	c.backup = true
 }
 
+// SetBackupRetention tells collection which backups to keep when making a backup
+func (c *Collection) SetBackupRetention(retention BackupRetention) {
+	c.retention = retention
+}
+
 func copy(src, dst string, bufferSize int64) error {
 	sourceFileStat, err := os.Stat(src)
 	if err != nil {
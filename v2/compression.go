@@ -0,0 +1,180 @@
+package sbrdata
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression selects how collection files are compressed
+type Compression uint8
+
+const (
+	// CompressionNone writes plain JSON files named key.json
+	CompressionNone = Compression(0)
+	// CompressionGzip writes gzip compressed JSON files named key.json.gz
+	CompressionGzip = Compression(1)
+	// CompressionZstd writes zstd compressed JSON files named key.json.zst
+	CompressionZstd = Compression(2)
+)
+
+const (
+	// CompressionNameNone is the name of CompressionNone
+	CompressionNameNone = "none"
+	// CompressionNameGzip is the name of CompressionGzip
+	CompressionNameGzip = "gzip"
+	// CompressionNameZstd is the name of CompressionZstd
+	CompressionNameZstd = "zstd"
+)
+
+// collectionExtensions holds the file name extension of collection files per compression
+var collectionExtensions = []string{
+	CompressionNone: ".json",
+	CompressionGzip: ".json.gz",
+	CompressionZstd: ".json.zst",
+}
+
+var (
+	// gzipMagic starts every gzip stream
+	gzipMagic = []byte{0x1f, 0x8b}
+	// zstdMagic starts every zstd frame
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// CompressionByName returns the compression with the given name.
+// Valid names are CompressionNameNone, CompressionNameGzip and CompressionNameZstd.
+func CompressionByName(name string) (Compression, error) {
+	switch name {
+	case CompressionNameNone, "":
+		return CompressionNone, nil
+	case CompressionNameGzip:
+		return CompressionGzip, nil
+	case CompressionNameZstd:
+		return CompressionZstd, nil
+	}
+	return CompressionNone, fmt.Errorf("no such compression %q", name)
+}
+
+// String returns the name of the compression
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return CompressionNameNone
+	case CompressionGzip:
+		return CompressionNameGzip
+	case CompressionZstd:
+		return CompressionNameZstd
+	}
+	return fmt.Sprintf("Compression(%d)", uint8(c))
+}
+
+// Extension returns the file name extension of collection files written with the compression
+func (c Compression) Extension() string {
+	if int(c) >= len(collectionExtensions) {
+		return collectionExtensions[CompressionNone]
+	}
+	return collectionExtensions[c]
+}
+
+// compressionOf returns the compression matching the extension of the file name
+func compressionOf(name string) Compression {
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		return CompressionGzip
+	case strings.HasSuffix(name, ".zst"):
+		return CompressionZstd
+	}
+	return CompressionNone
+}
+
+// cutCollectionExtension removes the extension of a collection file from name. The second value is false
+// if name is not a collection file.
+func cutCollectionExtension(name string) (string, bool) {
+	for _, ext := range collectionExtensions {
+		if base, ok := strings.CutSuffix(name, ext); ok {
+			return base, true
+		}
+	}
+	return name, false
+}
+
+// splitExtension splits name into base name and extension, keeping .json and the compression together
+func splitExtension(name string) (string, string) {
+	if base, ok := cutCollectionExtension(name); ok {
+		return base, name[len(base):]
+	}
+	ext := filepath.Ext(name)
+	return name[:len(name)-len(ext)], ext
+}
+
+// compress returns data compressed using c
+func compress(data []byte, c Compression) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionZstd:
+		w, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer w.Close()
+		return w.EncodeAll(data, nil), nil
+	}
+	return nil, fmt.Errorf("no such compression %d", c)
+}
+
+// decompress returns the content of data, which is detected to be gzip or zstd compressed by its magic
+// number. Anything else is returned as is.
+func decompress(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case bytes.HasPrefix(data, zstdMagic):
+		r, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return r.DecodeAll(data, nil)
+	}
+	return data, nil
+}
+
+// readCollectionFile reads the file at path, decrypting it using key and decompressing it if required.
+// Unencrypted files are refused if encryptedOnly is set.
+func readCollectionFile(path string, key *EncryptionKey, encryptedOnly bool) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err = unsealFrom(data, key, encryptedOnly)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %q: %w", path, err)
+	}
+	data, err = decompress(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress %q: %w", path, err)
+	}
+	return data, nil
+}
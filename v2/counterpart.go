@@ -0,0 +1,58 @@
+package sbrdata
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+)
+
+// counterpartDirectory is the directory below the base directory holding one collection per counterpart
+const counterpartDirectory = "counterparts"
+
+// unknownCounterpart is the file name used for records without any number
+const unknownCounterpart = "unknown"
+
+// Counterpart returns the collection holding the complete history with number. The number is normalized
+// using NormalizeNumber, group MMS use all numbers joined by ~ in any order.
+// It requires the GroupByCounterpart grouping period.
+func (gc *GroupedCollection) Counterpart(number string) (*Collection, error) {
+	if gc.groupPeriod != GroupByCounterpart {
+		return nil, errors.New("counterpart collections require grouping by counterpart")
+	}
+	return gc.Get(counterpartKey(number))
+}
+
+// counterpartKey returns the key of the collection for number, which is the normalized number
+// made safe to be used as file name. Dots are replaced to not confuse names with backup files.
+func counterpartKey(number string) string {
+	numbers := strings.Split(NormalizeNumber(number), "~")
+	sort.Strings(numbers)
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= '0' && r <= '9', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+			return r
+		case r == '+' || r == '~' || r == '-' || r == '_' || r == '@':
+			return r
+		}
+		return '_'
+	}, strings.Join(numbers, "~"))
+	name = strings.Trim(name, "~")
+	if name == "" {
+		name = unknownCounterpart
+	}
+	return path.Join(counterpartDirectory, name)
+}
+
+// counterpartOf returns the key of the collection the record of a FailedRecord belongs to
+func counterpartOf(record FailedRecord) string {
+	switch {
+	case record.Call != nil:
+		return counterpartKey(record.Call.Number)
+	case record.Sms != nil:
+		return counterpartKey(record.Sms.Address)
+	case record.Mms != nil:
+		return counterpartKey(record.Mms.Address)
+	}
+	return counterpartKey("")
+}
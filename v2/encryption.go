@@ -0,0 +1,426 @@
+package sbrdata
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	// ErrEncrypted is returned when reading encrypted data without a key
+	ErrEncrypted = errors.New("data is encrypted, a passphrase or key file is required")
+	// ErrWrongKey is returned when reading data encrypted with another passphrase or key file
+	ErrWrongKey = errors.New("wrong passphrase or key file")
+	// ErrUnencrypted is returned when reading unencrypted data from an encrypted base directory
+	ErrUnencrypted = errors.New("data is not encrypted, although the base directory is")
+	// errCounterpartEncryption refuses encrypting base directories grouped by counterpart
+	errCounterpartEncryption = errors.New("encryption is not supported when grouping by counterpart, as the file names hold the numbers")
+)
+
+// encryptionMagic starts all data encrypted by this package
+var encryptionMagic = []byte("SBRENC")
+
+// keyCheckText is encrypted into the manifest to detect wrong keys when opening a base directory
+var keyCheckText = []byte("sbrdata key check")
+
+// blobNameText derives the key naming the attachment files of an encrypted base directory
+var blobNameText = []byte("sbrdata blob names")
+
+const (
+	// encryptionVersion is the version of the format of encrypted data
+	encryptionVersion = 1
+	// kdfArgon2id derives the key from a passphrase using argon2id
+	kdfArgon2id = 1
+	// kdfHKDF derives the key from the content of a key file using HKDF-SHA256
+	kdfHKDF = 2
+	// saltSize is the size of the salt used to derive keys
+	saltSize = 16
+	// keyCheckSize is the size of the value in the header telling whether the right key is used
+	keyCheckSize = 8
+	// nonceSize is the size of the AES-GCM nonce
+	nonceSize = 12
+	// encryptionHeaderSize is the size of the header: magic, version, kdf, argon2 time, memory and threads,
+	// salt, key check and nonce
+	encryptionHeaderSize = 6 + 1 + 1 + 4 + 4 + 1 + saltSize + keyCheckSize + nonceSize
+	// minimumKeyFileSize is the least number of bytes a key file must hold
+	minimumKeyFileSize = 16
+)
+
+// argon2id parameters used for new passphrase derived keys
+const (
+	argon2Time    = 1
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+)
+
+// upper bounds of the argon2id parameters accepted from the header of encrypted data, so a crafted file cannot
+// make deriving the key allocate gigabytes or run for hours
+const (
+	argon2MaxTime    = 16
+	argon2MaxMemory  = 256 * 1024
+	argon2MaxThreads = 16
+)
+
+// kdfParams describes how a key was derived, it is stored in the header of encrypted data
+type kdfParams struct {
+	kdf     byte
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    [saltSize]byte
+}
+
+// derivedKey is a key derived for a set of kdfParams
+type derivedKey struct {
+	// aead encrypts and authenticates using AES-256-GCM
+	aead cipher.AEAD
+	// check is stored in the header to tell a wrong key from damaged data
+	check []byte
+	// names keys the hashes naming attachment files
+	names []byte
+}
+
+// EncryptionKey encrypts collection files, documents and attachments using AES-256-GCM with a key derived from a
+// passphrase or a key file. Every encrypted file records how its key was derived, including the salt, so it can be
+// decrypted on its own. Derived keys are cached, as deriving from a passphrase is slow on purpose.
+type EncryptionKey struct {
+	// kdf is kdfArgon2id for passphrases or kdfHKDF for key files
+	kdf byte
+	// secret is the passphrase or the content of the key file
+	secret []byte
+	// mu guards params and derived
+	mu sync.Mutex
+	// params is used to encrypt, nil until a salt is chosen
+	params *kdfParams
+	// derived caches the keys derived so far
+	derived map[kdfParams]*derivedKey
+}
+
+// KeyFromPassphrase returns a key derived from passphrase using argon2id
+func KeyFromPassphrase(passphrase string) (*EncryptionKey, error) {
+	if passphrase == "" {
+		return nil, errors.New("passphrase must be non empty")
+	}
+	return &EncryptionKey{kdf: kdfArgon2id, secret: []byte(passphrase), derived: make(map[kdfParams]*derivedKey)}, nil
+}
+
+// KeyFromFile returns a key derived from the content of the key file at path using HKDF. The file should hold
+// random data, at least 16 bytes, e.g. created by head -c 32 /dev/urandom.
+func KeyFromFile(path string) (*EncryptionKey, error) {
+	secret, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) < minimumKeyFileSize {
+		return nil, fmt.Errorf("key file %q must hold at least %d bytes", path, minimumKeyFileSize)
+	}
+	return &EncryptionKey{kdf: kdfHKDF, secret: secret, derived: make(map[kdfParams]*derivedKey)}, nil
+}
+
+// NewEncryptionKey returns a key derived from passphrase or the key file at keyFile, whichever is given.
+// Without both, nil is returned, meaning no encryption.
+func NewEncryptionKey(passphrase, keyFile string) (*EncryptionKey, error) {
+	switch {
+	case passphrase != "" && keyFile != "":
+		return nil, errors.New("provide either a passphrase or a key file")
+	case passphrase != "":
+		return KeyFromPassphrase(passphrase)
+	case keyFile != "":
+		return KeyFromFile(keyFile)
+	}
+	return nil, nil
+}
+
+// kdfName returns how the key is provided, for error messages
+func kdfName(kdf byte) string {
+	if kdf == kdfHKDF {
+		return "a key file"
+	}
+	return "a passphrase"
+}
+
+// derive returns the key for params, deriving it on first use
+func (k *EncryptionKey) derive(params kdfParams) (*derivedKey, error) {
+	if dk, ok := k.derived[params]; ok {
+		return dk, nil
+	}
+	key := make([]byte, 32)
+	switch params.kdf {
+	case kdfArgon2id:
+		key = argon2.IDKey(k.secret, params.salt[:], params.time, params.memory, params.threads, 32)
+	case kdfHKDF:
+		if _, err := io.ReadFull(hkdf.New(sha256.New, k.secret, params.salt[:], []byte("sbrdata")), key); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key derivation %d", params.kdf)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(keyCheckText)
+	names := hmac.New(sha256.New, key)
+	names.Write(blobNameText)
+	dk := &derivedKey{aead: aead, check: mac.Sum(nil)[:keyCheckSize], names: names.Sum(nil)}
+	k.derived[params] = dk
+	return dk, nil
+}
+
+// current returns the key used to encrypt. A random salt is chosen on first use unless the key was bound to one.
+// The caller must hold mu.
+func (k *EncryptionKey) current() (*derivedKey, error) {
+	if k.params == nil {
+		params := kdfParams{kdf: k.kdf}
+		if k.kdf == kdfArgon2id {
+			params.time, params.memory, params.threads = argon2Time, argon2Memory, argon2Threads
+		}
+		if _, err := rand.Read(params.salt[:]); err != nil {
+			return nil, err
+		}
+		k.params = &params
+	}
+	return k.derive(*k.params)
+}
+
+// encrypt returns plaintext encrypted and authenticated, prefixed with the header telling how to decrypt it
+func (k *EncryptionKey) encrypt(plaintext []byte) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	dk, err := k.current()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, encryptionHeaderSize)
+	header = append(header, encryptionMagic...)
+	header = append(header, encryptionVersion, k.params.kdf)
+	header = binary.BigEndian.AppendUint32(header, k.params.time)
+	header = binary.BigEndian.AppendUint32(header, k.params.memory)
+	header = append(header, k.params.threads)
+	header = append(header, k.params.salt[:]...)
+	header = append(header, dk.check...)
+	nonce := make([]byte, nonceSize)
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+	result := append(make([]byte, 0, len(header)+len(plaintext)+dk.aead.Overhead()), header...)
+	return dk.aead.Seal(result, nonce, plaintext, header), nil
+}
+
+// decrypt returns the plaintext of data written by encrypt. An error wrapping ErrWrongKey is returned if data was
+// encrypted using another passphrase or key file.
+func (k *EncryptionKey) decrypt(data []byte) ([]byte, error) {
+	params, check, err := parseEncryptionHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if params.kdf != k.kdf {
+		return nil, fmt.Errorf("%w: data is encrypted using %s, not %s", ErrWrongKey, kdfName(params.kdf), kdfName(k.kdf))
+	}
+	k.mu.Lock()
+	dk, err := k.derive(params)
+	k.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(check, dk.check) {
+		return nil, ErrWrongKey
+	}
+	header := data[:encryptionHeaderSize]
+	plaintext, err := dk.aead.Open(nil, header[encryptionHeaderSize-nonceSize:], data[encryptionHeaderSize:], header)
+	if err != nil {
+		return nil, errors.New("could not decrypt: data is damaged or was modified")
+	}
+	return plaintext, nil
+}
+
+// blobName returns the file name of the attachment with reference ref, a keyed hash of ref. Attachment references
+// are the sha256 of the content, which would tell whether a base directory holds a known file.
+func (k *EncryptionKey) blobName(ref string) (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	dk, err := k.current()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, dk.names)
+	mac.Write([]byte(ref))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// bind decrypts data and uses the salt it was encrypted with for everything encrypted afterward, so a base
+// directory is encrypted using a single derived key
+func (k *EncryptionKey) bind(data []byte) error {
+	if _, err := k.decrypt(data); err != nil {
+		return err
+	}
+	params, _, err := parseEncryptionHeader(data)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.params = &params
+	k.mu.Unlock()
+	return nil
+}
+
+// parseEncryptionHeader returns the key derivation parameters and the key check from the header of data
+func parseEncryptionHeader(data []byte) (kdfParams, []byte, error) {
+	var params kdfParams
+	if !isEncrypted(data) {
+		return params, nil, errors.New("data is not encrypted")
+	}
+	if len(data) < encryptionHeaderSize {
+		return params, nil, errors.New("could not decrypt: data is truncated")
+	}
+	h := data[len(encryptionMagic):]
+	if h[0] != encryptionVersion {
+		return params, nil, fmt.Errorf("unsupported encryption version %d", h[0])
+	}
+	params.kdf = h[1]
+	params.time = binary.BigEndian.Uint32(h[2:6])
+	params.memory = binary.BigEndian.Uint32(h[6:10])
+	params.threads = h[10]
+	params.salt = [saltSize]byte(h[11 : 11+saltSize])
+	if params.kdf == kdfArgon2id && (params.time == 0 || params.time > argon2MaxTime || params.memory > argon2MaxMemory ||
+		params.threads == 0 || params.threads > argon2MaxThreads) {
+		return params, nil, errors.New("could not decrypt: invalid key derivation parameters")
+	}
+	return params, h[11+saltSize : 11+saltSize+keyCheckSize], nil
+}
+
+// isEncrypted returns true if data was written by encrypt
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptionMagic)
+}
+
+// seal returns data encrypted using key, data as is without a key
+func seal(data []byte, key *EncryptionKey) ([]byte, error) {
+	if key == nil {
+		return data, nil
+	}
+	return key.encrypt(data)
+}
+
+// unseal returns the plaintext of data, decrypting it if it is encrypted. An error wrapping ErrEncrypted is
+// returned for encrypted data without a key.
+func unseal(data []byte, key *EncryptionKey) ([]byte, error) {
+	if !isEncrypted(data) {
+		return data, nil
+	}
+	if key == nil {
+		return nil, ErrEncrypted
+	}
+	return key.decrypt(data)
+}
+
+// unsealFrom is unseal for data read from a base directory. If encryptedOnly is set, as for encrypted base
+// directories, unencrypted data is refused with ErrUnencrypted, so it cannot be swapped in unnoticed.
+func unsealFrom(data []byte, key *EncryptionKey, encryptedOnly bool) ([]byte, error) {
+	if encryptedOnly && !isEncrypted(data) {
+		return nil, ErrUnencrypted
+	}
+	return unseal(data, key)
+}
+
+// checkKey verifies the key of gc against the key check in the manifest. Base directories encrypted before
+// require a key, the first time a key is used the key check is added to the manifest. Once all files are encrypted,
+// unencrypted files are refused. Encrypting a base directory holding unencrypted files leaves them as they are, a
+// warning is logged until RotateKey encrypted them.
+func (gc *GroupedCollection) checkKey() error {
+	m := gc.manifest
+	if gc.key != nil && gc.groupPeriod == GroupByCounterpart {
+		return errCounterpartEncryption
+	}
+	switch {
+	case len(m.KeyCheck) > 0 && gc.key == nil:
+		return fmt.Errorf("could not open base directory: %w", ErrEncrypted)
+	case len(m.KeyCheck) > 0:
+		if err := gc.key.bind(m.KeyCheck); err != nil {
+			return fmt.Errorf("could not open base directory: %w", err)
+		}
+	case gc.key != nil:
+		names, err := gc.unencryptedFiles()
+		if err != nil {
+			return err
+		}
+		m.Unencrypted = len(names) > 0
+		if m.KeyCheck, err = gc.key.encrypt(keyCheckText); err != nil {
+			return err
+		}
+		gc.manifestDirty = true
+	default:
+		return nil
+	}
+	if m.Unencrypted {
+		log.Printf("warning: base directory %q holds files written before it was encrypted, they stay unencrypted until encrypted using rotate-key", gc.baseDirectory)
+		return nil
+	}
+	if store, ok := gc.store.(*JSONStore); ok {
+		store.encryptedOnly = true
+		store.blobs.encryptedOnly = true
+	}
+	return nil
+}
+
+// unencryptedFiles returns the names of the files in the base directory of gc that are not encrypted, though they
+// would be in an encrypted base directory
+func (gc *GroupedCollection) unencryptedFiles() ([]string, error) {
+	store, ok := gc.store.(*JSONStore)
+	if !ok {
+		return nil, nil
+	}
+	if _, err := os.Stat(store.Directory()); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	names, err := encryptedFiles(store.Directory())
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, name := range names {
+		encrypted, err := isEncryptedFile(filepath.Join(store.Directory(), name))
+		if err != nil {
+			return nil, err
+		}
+		if !encrypted {
+			result = append(result, name)
+		}
+	}
+	return result, nil
+}
+
+// isEncryptedFile returns true if the file at p starts like data written by encrypt
+func isEncryptedFile(p string) (bool, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	header := make([]byte, len(encryptionMagic))
+	if _, err = io.ReadFull(f, header); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	return isEncrypted(header), nil
+}
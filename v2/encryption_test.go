@@ -0,0 +1,238 @@
+package sbrdata
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func mustKey(t *testing.T, passphrase string) *EncryptionKey {
+	t.Helper()
+	key, err := KeyFromPassphrase(passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func mustKeyFile(t *testing.T, content string) *EncryptionKey {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := KeyFromFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSealUnseal(t *testing.T) {
+	plaintext := []byte(`{"calls":[],"sms":[],"mms":[]}`)
+	tests := []struct {
+		name string
+		key  *EncryptionKey
+	}{
+		{name: "passphrase", key: mustKey(t, "correct horse battery staple")},
+		{name: "key file", key: mustKeyFile(t, "0123456789abcdef0123456789abcdef")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed, err := seal(plaintext, tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !isEncrypted(sealed) || bytes.Contains(sealed, plaintext) {
+				t.Fatal("sealed data is not encrypted")
+			}
+			again, err := seal(plaintext, tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(sealed, again) {
+				t.Error("sealing twice returned the same data, nonce is reused")
+			}
+			got, err := unseal(sealed, tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Errorf("got %q, want %q", got, plaintext)
+			}
+		})
+	}
+}
+
+func TestSealWithoutKey(t *testing.T) {
+	plaintext := []byte("plain")
+	sealed, err := seal(plaintext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sealed, plaintext) {
+		t.Errorf("got %q, want data as is", sealed)
+	}
+	got, err := unseal(plaintext, mustKey(t, "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("got %q, want data as is", got)
+	}
+	if _, err = unsealFrom(plaintext, nil, true); !errors.Is(err, ErrUnencrypted) {
+		t.Errorf("got %v, want ErrUnencrypted", err)
+	}
+}
+
+func TestUnsealErrors(t *testing.T) {
+	key := mustKey(t, "secret")
+	sealed, err := seal([]byte("some message"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 0xff
+	// a header claiming argon2 parameters beyond the bounds must be refused before deriving a key
+	hugeMemory := bytes.Clone(sealed)
+	binary.BigEndian.PutUint32(hugeMemory[len(encryptionMagic)+6:], 1<<30)
+	noThreads := bytes.Clone(sealed)
+	noThreads[len(encryptionMagic)+10] = 0
+	badVersion := bytes.Clone(sealed)
+	badVersion[len(encryptionMagic)] = encryptionVersion + 1
+	tests := []struct {
+		name    string
+		data    []byte
+		key     *EncryptionKey
+		wantErr error
+	}{
+		{name: "no key", data: sealed, wantErr: ErrEncrypted},
+		{name: "wrong passphrase", data: sealed, key: mustKey(t, "other"), wantErr: ErrWrongKey},
+		{name: "key file instead of passphrase", data: sealed, key: mustKeyFile(t, "0123456789abcdef"), wantErr: ErrWrongKey},
+		{name: "truncated header", data: sealed[:encryptionHeaderSize-1], key: key},
+		{name: "magic only", data: encryptionMagic, key: key},
+		{name: "truncated ciphertext", data: sealed[:len(sealed)-1], key: key},
+		{name: "header only", data: sealed[:encryptionHeaderSize], key: key},
+		{name: "tampered ciphertext", data: tampered, key: key},
+		{name: "argon2 memory out of bounds", data: hugeMemory, key: key},
+		{name: "argon2 without threads", data: noThreads, key: key},
+		{name: "unsupported version", data: badVersion, key: key},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := unseal(tt.data, tt.key)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && (errors.Is(err, ErrWrongKey) || errors.Is(err, ErrEncrypted)) {
+				t.Errorf("damaged data reported as key problem: %v", err)
+			}
+		})
+	}
+}
+
+func TestBindKey(t *testing.T) {
+	first := mustKey(t, "secret")
+	check, err := first.encrypt(keyCheckText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mustKey(t, "other").bind(check); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("got %v, want ErrWrongKey", err)
+	}
+	second := mustKey(t, "secret")
+	if err = second.bind(check); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := seal([]byte("data"), second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saltStart := len(encryptionMagic) + 11
+	if !bytes.Equal(sealed[saltStart:saltStart+saltSize], check[saltStart:saltStart+saltSize]) {
+		t.Error("bound key does not use the salt of the key check")
+	}
+	if _, err = unseal(sealed, first); err != nil {
+		t.Errorf("data sealed by bound key cannot be read using the first key: %s", err)
+	}
+}
+
+// blobNames returns the names of all attachment files in the base directory dir
+func blobNames(t *testing.T, dir string) []string {
+	t.Helper()
+	var names []string
+	err := filepath.WalkDir(filepath.Join(dir, blobDirectory), func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			names = append(names, d.Name())
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestEncryptedBaseDirectory(t *testing.T) {
+	dir := t.TempDir()
+	key := mustKeyFile(t, "0123456789abcdef0123456789abcdef")
+	if _, err := NewGroupedCollection(SetBaseDirectory(dir), SetGroupPeriod(GroupByCounterpart), SetEncryptionKey(key)); err == nil {
+		t.Fatal("encrypting a base directory grouped by counterpart succeeded")
+	}
+	gc := openTestCollection(t, dir, SetEncryptionKey(key))
+	mms := MMS{Address: "+491711", Date: may2023, Parts: Parts{Part: []Part{{Seq: "0", Ct: "image/png", Data: "aGVsbG8="}}}}
+	if _, err := gc.AddMessages(Messages{Mms: []MMS{mms}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gc.Save(); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("hello"))
+	ref := hex.EncodeToString(sum[:])
+	if names := blobNames(t, dir); len(names) != 1 || names[0] == ref {
+		t.Errorf("got attachment files %v, want one not named by the hash of its content", names)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "2023/05") {
+		t.Errorf("manifest shows the record counts: %s", data)
+	}
+
+	gc = openTestCollection(t, dir, SetEncryptionKey(mustKeyFile(t, "0123456789abcdef0123456789abcdef")))
+	if counts := gc.Manifest().Counts["2023/05"]; counts.Mms != 1 {
+		t.Errorf("got counts %s, want 1 mms", counts)
+	}
+	if err = RotateKey(gc, nil); err != nil {
+		t.Fatal(err)
+	}
+	if names := blobNames(t, dir); len(names) != 1 || names[0] != ref {
+		t.Errorf("got attachment files %v, want %s after removing the encryption", names, ref)
+	}
+	gc = openTestCollection(t, dir)
+	if err = RotateKey(gc, mustKey(t, "secret")); err != nil {
+		t.Fatal(err)
+	}
+	if names := blobNames(t, dir); len(names) != 1 || names[0] == ref {
+		t.Errorf("got attachment files %v, want one renamed when encrypting", names)
+	}
+	gc = openTestCollection(t, dir, SetEncryptionKey(mustKey(t, "secret")))
+	data, err = gc.Blobs().Get(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("got attachment %q, want hello", data)
+	}
+}
@@ -0,0 +1,173 @@
+package sbrdata
+
+import (
+	"fmt"
+	"iter"
+	"strings"
+	"time"
+)
+
+// Direction tells whether a call or message was incoming or outgoing
+type Direction string
+
+const (
+	// DirectionIncoming is a received call or message
+	DirectionIncoming = Direction("incoming")
+	// DirectionOutgoing is a placed call or sent message
+	DirectionOutgoing = Direction("outgoing")
+	// DirectionMissed is a missed incoming call, including voicemail
+	DirectionMissed = Direction("missed")
+	// DirectionRejected is a rejected or blocked incoming call
+	DirectionRejected = Direction("rejected")
+	// DirectionUnknown is used if the type of the record is unknown
+	DirectionUnknown = Direction("unknown")
+)
+
+// previewLength is the maximum number of runes returned by Event.Preview
+const previewLength = 80
+
+// EventData is implemented by everything that can be represented as an Event
+type EventData interface {
+	Event() Event
+}
+
+// Event is the normalized view on a call, SMS or MMS, allowing timelines and reports
+// to treat them uniformly
+type Event struct {
+	// Kind is one of KindCall, KindSms or KindMms
+	Kind string
+	// Time is the parsed date of the record, zero if the date could not be parsed
+	Time time.Time
+	// Direction of the call or message
+	Direction Direction
+	// Numbers holds the counterparts, more than one for group messages
+	Numbers []string
+	// ContactName is the name of the counterpart as known to the phone
+	ContactName string
+	// Text is the body of a message or a short description of a call
+	Text string
+	// Record is the original call or message
+	Record Record
+}
+
+// Preview returns the text of the event on a single line, shortened to a length suitable for listings
+func (e Event) Preview() string {
+	text := strings.Join(strings.Fields(e.Text), " ")
+	runes := []rune(text)
+	if len(runes) <= previewLength {
+		return text
+	}
+	return string(runes[:previewLength-1]) + "…"
+}
+
+// String returns the event in a form suitable for listings
+func (e Event) String() string {
+	return fmt.Sprintf("%s %-4s %-8s %s (%s): %s", e.Time.Format("2006-01-02 15:04:05"), e.Kind, e.Direction, strings.Join(e.Numbers, ", "), e.ContactName, e.Preview())
+}
+
+// Event converts the call into an Event
+func (c Call) Event() Event {
+	d, _ := c.Time()
+	direction := DirectionUnknown
+	if ct, err := c.CallType(); err == nil {
+		direction = ct.Direction()
+	}
+	text := c.Duration
+	if duration, err := c.CallDuration(); err == nil {
+		text = duration.String()
+	}
+	return Event{
+		Kind:        KindCall,
+		Time:        d,
+		Direction:   direction,
+		Numbers:     []string{c.Number},
+		ContactName: c.ContactName,
+		Text:        text,
+		Record:      Record{Time: d, Call: &c},
+	}
+}
+
+// Event converts the SMS into an Event
+func (S SMS) Event() Event {
+	d, _ := S.Time()
+	return Event{
+		Kind:        KindSms,
+		Time:        d,
+		Direction:   messageDirection(S.Box()),
+		Numbers:     []string{S.Address},
+		ContactName: S.ContactName,
+		Text:        S.Body,
+		Record:      Record{Time: d, Sms: &S},
+	}
+}
+
+// Event converts the MMS into an Event. The text consists of all text parts, other parts are
+// listed by their content type. Group messages have one number per recipient.
+func (M MMS) Event() Event {
+	d, _ := M.Time()
+	var texts []string
+	for _, p := range M.Parts.GetPart() {
+		switch {
+		case p.Ct == "application/smil":
+		case strings.HasPrefix(p.Ct, "text/"):
+			if p.AttrText != "null" {
+				texts = append(texts, p.AttrText)
+			}
+		default:
+			texts = append(texts, fmt.Sprintf("[%s]", p.Ct))
+		}
+	}
+	return Event{
+		Kind:        KindMms,
+		Time:        d,
+		Direction:   messageDirection(M.Box()),
+		Numbers:     strings.Split(M.Address, "~"),
+		ContactName: M.ContactName,
+		Text:        strings.Join(texts, " "),
+		Record:      Record{Time: d, Mms: &M},
+	}
+}
+
+// Event converts the call or message of the record into an Event
+func (r Record) Event() Event {
+	switch {
+	case r.Call != nil:
+		return r.Call.Event()
+	case r.Sms != nil:
+		return r.Sms.Event()
+	case r.Mms != nil:
+		return r.Mms.Event()
+	}
+	return Event{Direction: DirectionUnknown, Record: r}
+}
+
+// IterEvents returns an iterator over all calls and messages as events in chronological order.
+// Collections are loaded one at a time, collections not loaded before are not kept in memory.
+// Iteration stops after yielding an error.
+func (gc *GroupedCollection) IterEvents() iter.Seq2[Event, error] {
+	return gc.IterEventsBetween(time.Time{}, time.Time{})
+}
+
+// IterEventsBetween returns an iterator over all calls and messages within the time range [from, to)
+// as events in chronological order. See IterRecordsBetween for details.
+func (gc *GroupedCollection) IterEventsBetween(from, to time.Time) iter.Seq2[Event, error] {
+	return func(yield func(Event, error) bool) {
+		for r, err := range gc.IterRecordsBetween(from, to) {
+			if err != nil {
+				yield(Event{}, err)
+				return
+			}
+			if !yield(r.Event(), nil) {
+				return
+			}
+		}
+	}
+}
+
+// messageDirection maps the result of the Box accessor of a SMS or MMS to a direction
+func messageDirection(box MessageBox, err error) Direction {
+	if err != nil {
+		return DirectionUnknown
+	}
+	return box.Direction()
+}
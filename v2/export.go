@@ -0,0 +1,380 @@
+package sbrdata
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// messagesElement is the root element of a SMS Backup & Restore message export
+	messagesElement = "smses"
+	// callsElement is the root element of a SMS Backup & Restore call export
+	callsElement = "calls"
+	// exportHeader is the XML declaration written by SMS Backup & Restore
+	exportHeader = "<?xml version='1.0' encoding='UTF-8' standalone='yes' ?>\n"
+)
+
+// ExportOptions selects the records written by ExportMessages, ExportCalls, WriteMessages and WriteCalls
+type ExportOptions struct {
+	// Filter selects the records to export, nil exports all
+	Filter *Filter
+	// Quarantined includes the quarantined records with unparsable dates matching Filter after all other records.
+	// They are left out by default, as the phone cannot sort them either.
+	Quarantined bool
+}
+
+// ExportResult reports the number of records of an export
+type ExportResult struct {
+	// Records is the number of records written
+	Records int
+	// Quarantined is the number of quarantined records matching the filter, they are only part of Records if
+	// included using ExportOptions
+	Quarantined int
+}
+
+// ExportMessages writes the SMS and MMS messages of gc selected by opts to file as SMS Backup & Restore message
+// export, which can be restored to a phone. The export is written next to file and verified by reading it again
+// using StreamMessages, file is replaced only if the same messages are read back.
+func ExportMessages(gc *GroupedCollection, file string, opts ExportOptions) (ExportResult, error) {
+	return exportXML(gc, file, messagesElement, opts)
+}
+
+// ExportCalls writes the calls of gc selected by opts to file as SMS Backup & Restore call export, which can be
+// restored to a phone. The export is written next to file and verified by reading it again using StreamCalls,
+// file is replaced only if the same calls are read back.
+func ExportCalls(gc *GroupedCollection, file string, opts ExportOptions) (ExportResult, error) {
+	return exportXML(gc, file, callsElement, opts)
+}
+
+// WriteMessages writes the SMS and MMS messages selected by opts as SMS Backup & Restore message export to w.
+// Attachments are read from the blob store.
+func (gc *GroupedCollection) WriteMessages(w io.Writer, opts ExportOptions) (ExportResult, error) {
+	result, _, err := gc.writeXML(w, messagesElement, opts)
+	return result, err
+}
+
+// WriteCalls writes the calls selected by opts as SMS Backup & Restore call export to w
+func (gc *GroupedCollection) WriteCalls(w io.Writer, opts ExportOptions) (ExportResult, error) {
+	result, _, err := gc.writeXML(w, callsElement, opts)
+	return result, err
+}
+
+// exportXML writes the export with root element root to file.tmp, verifies it and renames it to file
+func exportXML(gc *GroupedCollection, file, root string, opts ExportOptions) (ExportResult, error) {
+	tmp := fmt.Sprintf("%s.tmp", file)
+	out, err := os.Create(tmp)
+	if err != nil {
+		return ExportResult{}, err
+	}
+	result, digest, err := gc.writeXML(out, root, opts)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = verifyExport(tmp, root, result.Records, digest)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return ExportResult{}, err
+	}
+	return result, os.Rename(tmp, file)
+}
+
+// writeXML writes all records selected by opts belonging to an export with root element root to w. The records are
+// counted first, as the count is an attribute of the root element, so collections are read twice instead of
+// holding all records in memory. Returned are the number of records and a digest of their content.
+func (gc *GroupedCollection) writeXML(w io.Writer, root string, opts ExportOptions) (ExportResult, []byte, error) {
+	var result ExportResult
+	f := opts.Filter
+	var from, to time.Time
+	if f != nil {
+		from, to = f.Range()
+	}
+	selected := func(r Record) bool {
+		if (root == callsElement) != (r.Call != nil) {
+			return false
+		}
+		return f == nil || f.MatchEvent(r.Event())
+	}
+	var quarantined []Record
+	for _, q := range gc.quarantine.Records {
+		if r := (Record{Call: q.Call, Sms: q.Sms, Mms: q.Mms}); selected(r) {
+			quarantined = append(quarantined, r)
+		}
+	}
+	result.Quarantined = len(quarantined)
+	if !opts.Quarantined {
+		quarantined = nil
+	}
+	count := len(quarantined)
+	for r, err := range gc.IterRecordsBetween(from, to) {
+		if err != nil {
+			return result, nil, err
+		}
+		if selected(r) {
+			count++
+		}
+	}
+	backupSet, err := newBackupSet()
+	if err != nil {
+		return result, nil, err
+	}
+	bw := bufio.NewWriter(w)
+	enc := xml.NewEncoder(bw)
+	enc.Indent("", "  ")
+	start := xml.StartElement{Name: xml.Name{Local: root}, Attr: []xml.Attr{
+		{Name: xml.Name{Local: "count"}, Value: strconv.Itoa(count)},
+		{Name: xml.Name{Local: "backup_set"}, Value: backupSet},
+		{Name: xml.Name{Local: "backup_date"}, Value: strconv.FormatInt(time.Now().UnixMilli(), 10)},
+		{Name: xml.Name{Local: "type"}, Value: "full"},
+	}}
+	if _, err = io.WriteString(bw, exportHeader); err != nil {
+		return result, nil, err
+	}
+	if err = enc.EncodeToken(start); err != nil {
+		return result, nil, err
+	}
+	digest := sha256.New()
+	for r, err := range gc.IterRecordsBetween(from, to) {
+		if err != nil {
+			return result, nil, err
+		}
+		if !selected(r) {
+			continue
+		}
+		if err = gc.writeRecord(enc, r, digest); err != nil {
+			return result, nil, err
+		}
+		result.Records++
+	}
+	for _, r := range quarantined {
+		if err = gc.writeRecord(enc, r, digest); err != nil {
+			return result, nil, err
+		}
+		result.Records++
+	}
+	if result.Records != count {
+		return result, nil, fmt.Errorf("records changed while exporting: counted %d, wrote %d", count, result.Records)
+	}
+	if err = enc.EncodeToken(start.End()); err != nil {
+		return result, nil, err
+	}
+	if err = enc.Close(); err != nil {
+		return result, nil, err
+	}
+	if _, err = io.WriteString(bw, "\n"); err != nil {
+		return result, nil, err
+	}
+	return result, digest.Sum(nil), bw.Flush()
+}
+
+// writeRecord writes the call, SMS or MMS of r as element and adds it to digest. Attachment payloads of MMS
+// are read from the blob store and written base64 encoded.
+func (gc *GroupedCollection) writeRecord(enc *xml.Encoder, r Record, digest hash.Hash) error {
+	switch {
+	case r.Call != nil:
+		return writeExportRecord(enc, "call", *r.Call, digest)
+	case r.Sms != nil:
+		return writeExportRecord(enc, "sms", *r.Sms, digest)
+	}
+	m := *r.Mms
+	// the parts are shared with the collection
+	m.Parts.Part = append([]Part(nil), m.Parts.Part...)
+	for i := range m.Parts.Part {
+		p := &m.Parts.Part[i]
+		if p.Blob == "" {
+			continue
+		}
+		data, err := gc.blobs.Get(p.Blob)
+		if err != nil {
+			return fmt.Errorf("could not export attachment of mms from %s: %w", m.Date, err)
+		}
+		p.Data = base64.StdEncoding.EncodeToString(data)
+		p.Blob = ""
+	}
+	return writeExportRecord(enc, "mms", m, digest)
+}
+
+// writeExportRecord writes record as element named name and adds it to digest
+func writeExportRecord[T Call | SMS | MMS](enc *xml.Encoder, name string, record T, digest hash.Hash) error {
+	if err := addToDigest(digest, record); err != nil {
+		return err
+	}
+	start := xml.StartElement{Name: xml.Name{Local: name}, Attr: exportAttributes(record)}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	if m, ok := any(record).(MMS); ok {
+		if err := writeMmsChildren(enc, m); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// writeMmsChildren writes the parts and addresses of m
+func writeMmsChildren(enc *xml.Encoder, m MMS) error {
+	parts := xml.StartElement{Name: xml.Name{Local: "parts"}}
+	if err := enc.EncodeToken(parts); err != nil {
+		return err
+	}
+	for _, p := range m.Parts.Part {
+		part := xml.StartElement{Name: xml.Name{Local: "part"}, Attr: exportAttributes(p)}
+		if err := enc.EncodeToken(part); err != nil {
+			return err
+		}
+		if err := enc.EncodeToken(part.End()); err != nil {
+			return err
+		}
+	}
+	if err := enc.EncodeToken(parts.End()); err != nil {
+		return err
+	}
+	addrs := xml.StartElement{Name: xml.Name{Local: "addrs"}}
+	if err := enc.EncodeToken(addrs); err != nil {
+		return err
+	}
+	for _, a := range m.Addrs.Addr {
+		addr := xml.StartElement{Name: xml.Name{Local: "addr"}, Attr: exportAttributes(a)}
+		if err := enc.EncodeToken(addr); err != nil {
+			return err
+		}
+		if strings.TrimSpace(a.Text) != "" {
+			if err := enc.EncodeToken(xml.CharData(a.Text)); err != nil {
+				return err
+			}
+		}
+		if err := enc.EncodeToken(addr.End()); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(addrs.End())
+}
+
+// exportAttributes returns the non-empty string fields of record tagged as xml attribute. Empty values are left
+// out, as they are read from missing attributes and restoring to a phone may fail on empty numeric attributes.
+func exportAttributes(record any) []xml.Attr {
+	v := reflect.ValueOf(record)
+	t := v.Type()
+	var result []xml.Attr
+	for i := 0; i < t.NumField(); i++ {
+		name, options, _ := strings.Cut(t.Field(i).Tag.Get("xml"), ",")
+		if options != "attr" || t.Field(i).Type.Kind() != reflect.String {
+			continue
+		}
+		if value := v.Field(i).String(); value != "" {
+			result = append(result, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+		}
+	}
+	return result
+}
+
+// addToDigest adds record to digest, ignoring whitespace between the addresses of a MMS
+func addToDigest(digest hash.Hash, record any) error {
+	if m, ok := record.(MMS); ok {
+		m.Addrs.Text = ""
+		m.Addrs.Addr = append([]Addr(nil), m.Addrs.Addr...)
+		for i := range m.Addrs.Addr {
+			if strings.TrimSpace(m.Addrs.Addr[i].Text) == "" {
+				m.Addrs.Addr[i].Text = ""
+			}
+		}
+		record = m
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = digest.Write(append(data, '\n'))
+	return err
+}
+
+// verifyExport reads the export in file using StreamMessages or StreamCalls and compares the count attribute,
+// the number of records and their content to what was written
+func verifyExport(file, root string, expected int, expectedDigest []byte) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	digest := sha256.New()
+	var found int
+	add := func(record any) error {
+		found++
+		return addToDigest(digest, record)
+	}
+	if root == callsElement {
+		err = StreamCalls(in, func(c Call) error { return add(c) })
+	} else {
+		err = StreamMessages(in, func(s SMS) error { return add(s) }, func(m MMS) error { return add(m) })
+	}
+	if err != nil {
+		return fmt.Errorf("verification of %q failed: %w", file, err)
+	}
+	if _, err = in.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	count, err := exportCount(in, root)
+	if err != nil {
+		return fmt.Errorf("verification of %q failed: %w", file, err)
+	}
+	switch {
+	case count != expected || found != expected:
+		return fmt.Errorf("verification of %q failed: expected %d records, count is %d, found %d", file, expected, count, found)
+	case !bytes.Equal(digest.Sum(nil), expectedDigest):
+		return fmt.Errorf("verification of %q failed: records read differ from records written", file)
+	}
+	return nil
+}
+
+// exportCount returns the count attribute of the root element of an export, which has to be named root
+func exportCount(r io.Reader, root string) (int, error) {
+	d := xml.NewDecoder(r)
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return 0, err
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if se.Name.Local != root {
+			return 0, fmt.Errorf("root element is %q, not %q", se.Name.Local, root)
+		}
+		for _, a := range se.Attr {
+			if a.Name.Local == "count" {
+				return strconv.Atoi(a.Value)
+			}
+		}
+		return 0, errors.New("root element has no count")
+	}
+}
+
+// newBackupSet returns a random UUID identifying an export, as SMS Backup & Restore does
+func newBackupSet() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
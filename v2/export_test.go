@@ -0,0 +1,166 @@
+package sbrdata
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openExportCollection returns a collection holding a call, an SMS, an MMS with attachment and a quarantined SMS
+func openExportCollection(t *testing.T) *GroupedCollection {
+	t.Helper()
+	gc := openTestCollection(t, t.TempDir())
+	if _, err := gc.AddCalls(Calls{Call: []Call{{Number: "+491711", Date: may2023, Type: "1", Duration: "42"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gc.AddMessages(Messages{
+		Sms: []SMS{
+			{Address: "+491711", Date: may2023, Type: "1", Body: "hello & <bye>"},
+			{Address: "+491712", Date: "yesterday", Type: "2", Body: "quarantined"},
+		},
+		Mms: []MMS{{Address: "+491711", Date: "1683676800001", MsgBox: "1",
+			Parts: Parts{Part: []Part{{Seq: "0", Ct: "image/png", Data: "aGVsbG8="}}},
+			Addrs: Addrs{Addr: []Addr{{Address: "+491711", Type: "137"}}},
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return gc
+}
+
+func TestExportMessages(t *testing.T) {
+	tests := []struct {
+		name        string
+		quarantined bool
+		want        ExportResult
+		wantBodies  []string
+	}{
+		{name: "without quarantined", want: ExportResult{Records: 2, Quarantined: 1}, wantBodies: []string{"hello & <bye>"}},
+		{name: "with quarantined", quarantined: true, want: ExportResult{Records: 3, Quarantined: 1}, wantBodies: []string{"hello & <bye>", "quarantined"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gc := openExportCollection(t)
+			file := filepath.Join(t.TempDir(), "sms.xml")
+			result, err := ExportMessages(gc, file, ExportOptions{Quarantined: tt.quarantined})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != tt.want {
+				t.Errorf("got %+v, want %+v", result, tt.want)
+			}
+			in, err := os.Open(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer in.Close()
+			var bodies, attachments []string
+			err = StreamMessages(in, func(s SMS) error {
+				bodies = append(bodies, s.Body)
+				return nil
+			}, func(m MMS) error {
+				for _, p := range m.Parts.Part {
+					attachments = append(attachments, p.Data)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(bodies, "|") != strings.Join(tt.wantBodies, "|") {
+				t.Errorf("got bodies %q, want %q", bodies, tt.wantBodies)
+			}
+			if len(attachments) != 1 || attachments[0] != "aGVsbG8=" {
+				t.Errorf("got attachments %q, want the payload read from the blob store", attachments)
+			}
+		})
+	}
+}
+
+func TestVerifyExport(t *testing.T) {
+	gc := openExportCollection(t)
+	var buf bytes.Buffer
+	result, digest, err := gc.writeXML(&buf, messagesElement, ExportOptions{Quarantined: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	export := buf.String()
+	tests := []struct {
+		name    string
+		change  func(export string) string
+		wantErr bool
+	}{
+		{name: "unchanged", change: func(export string) string { return export }},
+		{name: "changed body", change: func(export string) string {
+			return strings.Replace(export, "hello &amp;", "hallo &amp;", 1)
+		}, wantErr: true},
+		{name: "changed quarantined record", change: func(export string) string {
+			return strings.Replace(export, `body="quarantined"`, `body="changed"`, 1)
+		}, wantErr: true},
+		{name: "changed attachment", change: func(export string) string {
+			return strings.Replace(export, "aGVsbG8=", "aGFsbG8=", 1)
+		}, wantErr: true},
+		{name: "missing record", change: func(export string) string {
+			start := strings.Index(export, "<sms ")
+			end := strings.Index(export[start:], "</sms>") + start + len("</sms>")
+			return export[:start] + export[end:]
+		}, wantErr: true},
+		{name: "wrong count", change: func(export string) string {
+			return strings.Replace(export, `count="3"`, `count="4"`, 1)
+		}, wantErr: true},
+		{name: "calls instead of messages", change: func(export string) string {
+			return strings.ReplaceAll(export, "smses", "calls")
+		}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "sms.xml")
+			if err := os.WriteFile(file, []byte(tt.change(export)), 0600); err != nil {
+				t.Fatal(err)
+			}
+			err := verifyExport(file, messagesElement, result.Records, digest)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExportKeepsFileOnError(t *testing.T) {
+	gc := openExportCollection(t)
+	mms, err := gc.AllMms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := gc.blobs.(*BlobStore).Path(mms[0].Parts.Part[0].Blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(p); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "export.xml")
+	// the attachment is gone, but calls do not need it
+	result, err := ExportCalls(gc, file, ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Records != 1 {
+		t.Errorf("got %d calls, want 1", result.Records)
+	}
+	if _, err = ExportMessages(gc, file, ExportOptions{}); err == nil {
+		t.Fatal("exporting a missing attachment succeeded")
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `<calls count="1"`) {
+		t.Errorf("export was replaced on error: %s", data)
+	}
+	if _, err = os.Stat(file + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary export left behind: %v", err)
+	}
+}
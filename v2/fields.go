@@ -0,0 +1,201 @@
+package sbrdata
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ErrMalformedValue is wrapped by all errors returned from typed accessors for values that cannot be parsed
+var ErrMalformedValue = errors.New("malformed value")
+
+// CallType is the parsed type of a call
+type CallType uint8
+
+const (
+	// CallIncoming is an answered incoming call
+	CallIncoming = CallType(1)
+	// CallOutgoing is a placed call
+	CallOutgoing = CallType(2)
+	// CallMissed is an incoming call not answered
+	CallMissed = CallType(3)
+	// CallVoicemail is an incoming call that went to the voicemail
+	CallVoicemail = CallType(4)
+	// CallRejected is an incoming call declined by the user
+	CallRejected = CallType(5)
+	// CallBlocked is an incoming call blocked by the phone
+	CallBlocked = CallType(6)
+)
+
+// String returns the name of the call type
+func (ct CallType) String() string {
+	switch ct {
+	case CallIncoming:
+		return "incoming"
+	case CallOutgoing:
+		return "outgoing"
+	case CallMissed:
+		return "missed"
+	case CallVoicemail:
+		return "voicemail"
+	case CallRejected:
+		return "rejected"
+	case CallBlocked:
+		return "blocked"
+	}
+	return fmt.Sprintf("CallType(%d)", uint8(ct))
+}
+
+// Direction maps the call type to the direction of an Event. Voicemail counts as missed,
+// blocked calls as rejected.
+func (ct CallType) Direction() Direction {
+	switch ct {
+	case CallIncoming:
+		return DirectionIncoming
+	case CallOutgoing:
+		return DirectionOutgoing
+	case CallMissed, CallVoicemail:
+		return DirectionMissed
+	case CallRejected, CallBlocked:
+		return DirectionRejected
+	}
+	return DirectionUnknown
+}
+
+// MessageBox is the parsed type of a SMS or message box of a MMS
+type MessageBox uint8
+
+const (
+	// BoxInbox is a received message
+	BoxInbox = MessageBox(1)
+	// BoxSent is a sent message
+	BoxSent = MessageBox(2)
+	// BoxDraft is a message not sent yet
+	BoxDraft = MessageBox(3)
+	// BoxOutbox is a message about to be sent
+	BoxOutbox = MessageBox(4)
+	// BoxFailed is a message that could not be sent
+	BoxFailed = MessageBox(5)
+	// BoxQueued is a message queued to be sent later
+	BoxQueued = MessageBox(6)
+)
+
+// String returns the name of the message box
+func (mb MessageBox) String() string {
+	switch mb {
+	case BoxInbox:
+		return "inbox"
+	case BoxSent:
+		return "sent"
+	case BoxDraft:
+		return "draft"
+	case BoxOutbox:
+		return "outbox"
+	case BoxFailed:
+		return "failed"
+	case BoxQueued:
+		return "queued"
+	}
+	return fmt.Sprintf("MessageBox(%d)", uint8(mb))
+}
+
+// Direction maps the message box to the direction of an Event.
+// Everything except the inbox is considered outgoing.
+func (mb MessageBox) Direction() Direction {
+	switch mb {
+	case BoxInbox:
+		return DirectionIncoming
+	case BoxSent, BoxDraft, BoxOutbox, BoxFailed, BoxQueued:
+		return DirectionOutgoing
+	}
+	return DirectionUnknown
+}
+
+// parseUnixEpochMillis converts a string representation of a Unix epoch timestamp in milliseconds,
+// as used by SMS Backup & Restore, to a time.Time value.
+// If the conversion fails, an error wrapping ErrMalformedValue is returned.
+func parseUnixEpochMillis(date string) (time.Time, error) {
+	i, err := strconv.ParseInt(date, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: could not convert date %q to int", ErrMalformedValue, date)
+	}
+	return time.UnixMilli(i), nil
+}
+
+// parseEnum parses value as number between 1 and maximum
+func parseEnum(name, value string, maximum uint8) (uint8, error) {
+	i, err := strconv.ParseUint(value, 10, 8)
+	if err != nil || i == 0 || uint8(i) > maximum {
+		return 0, fmt.Errorf("%w: invalid %s %q", ErrMalformedValue, name, value)
+	}
+	return uint8(i), nil
+}
+
+// parseFlag parses the 0/1 flags used by SMS Backup & Restore
+func parseFlag(name, value string) (bool, error) {
+	switch value {
+	case "1":
+		return true, nil
+	case "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("%w: invalid %s flag %q", ErrMalformedValue, name, value)
+}
+
+// Time returns the parsed date of the call
+func (c Call) Time() (time.Time, error) {
+	return parseUnixEpochMillis(c.Date)
+}
+
+// CallDuration returns the parsed duration of the call
+func (c Call) CallDuration() (time.Duration, error) {
+	i, err := strconv.ParseInt(c.Duration, 10, 64)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("%w: invalid duration %q", ErrMalformedValue, c.Duration)
+	}
+	return time.Duration(i) * time.Second, nil
+}
+
+// CallType returns the parsed type of the call
+func (c Call) CallType() (CallType, error) {
+	i, err := parseEnum("call type", c.Type, uint8(CallBlocked))
+	return CallType(i), err
+}
+
+// Time returns the parsed date of the SMS
+func (S SMS) Time() (time.Time, error) {
+	return parseUnixEpochMillis(S.Date)
+}
+
+// Box returns the parsed type of the SMS
+func (S SMS) Box() (MessageBox, error) {
+	i, err := parseEnum("sms type", S.Type, uint8(BoxQueued))
+	return MessageBox(i), err
+}
+
+// IsRead returns true if the SMS was read
+func (S SMS) IsRead() (bool, error) {
+	return parseFlag("read", S.Read)
+}
+
+// Time returns the parsed date of the MMS
+func (M MMS) Time() (time.Time, error) {
+	return parseUnixEpochMillis(M.Date)
+}
+
+// Box returns the parsed message box of the MMS
+func (M MMS) Box() (MessageBox, error) {
+	i, err := parseEnum("message box", M.MsgBox, uint8(BoxQueued))
+	return MessageBox(i), err
+}
+
+// IsRead returns true if the MMS was read
+func (M MMS) IsRead() (bool, error) {
+	return parseFlag("read", M.Read)
+}
+
+// IsSeen returns true if the MMS was seen
+func (M MMS) IsSeen() (bool, error) {
+	return parseFlag("seen", M.Seen)
+}
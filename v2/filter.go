@@ -0,0 +1,355 @@
+package sbrdata
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Filter selects calls and messages using a small expression language.
+//
+// An expression consists of conditions of the form field:value, combined using AND, OR, NOT
+// and parentheses. AND binds stronger than OR, adjacent conditions without operator are combined
+// using AND. Values containing blanks have to be quoted using double quotes.
+//
+// Supported fields are
+//
+//	number     counterpart number contains value, compared after normalization
+//	name       contact name contains value, case insensitive
+//	direction  one of incoming, outgoing, missed or rejected
+//	kind       one of call, sms or mms
+//	after      record is at or after value (yyyy-mm-dd, yyyy-mm-ddThh:mm:ss or RFC3339)
+//	before     record is before value (same formats as after)
+//	body       text of the message contains value, case insensitive
+//
+// Example:
+//
+//	kind:sms AND (name:alice OR number:+49171) after:2023-01-01 NOT body:"see you"
+type Filter struct {
+	// root is the parsed expression
+	root filterNode
+	// location is used to interpret dates without time zone
+	location *time.Location
+}
+
+// filterNode is a node of the parsed filter expression
+type filterNode interface {
+	match(e Event) bool
+	// bounds returns the time range a matching record has to be in, zero values mean unbounded
+	bounds() (time.Time, time.Time)
+}
+
+type (
+	andNode   struct{ left, right filterNode }
+	orNode    struct{ left, right filterNode }
+	notNode   struct{ node filterNode }
+	matchNode struct {
+		field string
+		value string
+		time  time.Time
+	}
+)
+
+// ParseFilter parses expr into a Filter. Dates without time zone are interpreted in the local time zone.
+// An empty expression matches everything.
+func ParseFilter(expr string) (*Filter, error) {
+	return ParseFilterInLocation(expr, time.Local)
+}
+
+// ParseFilterInLocation parses expr into a Filter, interpreting dates without time zone in location
+func ParseFilterInLocation(expr string, location *time.Location) (*Filter, error) {
+	tokens, err := tokenizeFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	f := &Filter{location: location}
+	if len(tokens) == 0 {
+		return f, nil
+	}
+	p := &filterParser{tokens: tokens, location: location}
+	f.root, err = p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q at end of filter", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+// Range returns the time range a record has to be in to match the filter.
+// Zero values mean the range is open on that side.
+func (f *Filter) Range() (from, to time.Time) {
+	if f.root == nil {
+		return time.Time{}, time.Time{}
+	}
+	return f.root.bounds()
+}
+
+// MatchCall returns true if call matches the filter
+func (f *Filter) MatchCall(call Call) bool {
+	return f.MatchEvent(call.Event())
+}
+
+// MatchSms returns true if sms matches the filter
+func (f *Filter) MatchSms(sms SMS) bool {
+	return f.MatchEvent(sms.Event())
+}
+
+// MatchMms returns true if mms matches the filter
+func (f *Filter) MatchMms(mms MMS) bool {
+	return f.MatchEvent(mms.Event())
+}
+
+// MatchEvent returns true if e matches the filter
+func (f *Filter) MatchEvent(e Event) bool {
+	if f.root == nil {
+		return true
+	}
+	return f.root.match(e)
+}
+
+func (n andNode) match(e Event) bool { return n.left.match(e) && n.right.match(e) }
+
+func (n orNode) match(e Event) bool { return n.left.match(e) || n.right.match(e) }
+
+func (n notNode) match(e Event) bool { return !n.node.match(e) }
+
+func (n matchNode) match(e Event) bool {
+	switch n.field {
+	case "number":
+		for _, number := range e.Numbers {
+			if strings.Contains(NormalizeNumber(number), NormalizeNumber(n.value)) {
+				return true
+			}
+		}
+		return false
+	case "name":
+		return strings.Contains(strings.ToLower(e.ContactName), strings.ToLower(n.value))
+	case "direction":
+		return string(e.Direction) == n.value
+	case "kind":
+		return e.Kind == n.value
+	case "after":
+		return !e.Time.Before(n.time)
+	case "before":
+		return e.Time.Before(n.time)
+	case "body":
+		return e.Kind != KindCall && strings.Contains(strings.ToLower(e.Text), strings.ToLower(n.value))
+	}
+	return false
+}
+
+func (n andNode) bounds() (time.Time, time.Time) {
+	lf, lt := n.left.bounds()
+	rf, rt := n.right.bounds()
+	if rf.After(lf) {
+		lf = rf
+	}
+	if lt.IsZero() || (!rt.IsZero() && rt.Before(lt)) {
+		lt = rt
+	}
+	return lf, lt
+}
+
+func (n orNode) bounds() (time.Time, time.Time) {
+	lf, lt := n.left.bounds()
+	rf, rt := n.right.bounds()
+	if lf.IsZero() || rf.IsZero() {
+		lf = time.Time{}
+	} else if rf.Before(lf) {
+		lf = rf
+	}
+	if lt.IsZero() || rt.IsZero() {
+		lt = time.Time{}
+	} else if rt.After(lt) {
+		lt = rt
+	}
+	return lf, lt
+}
+
+func (n notNode) bounds() (time.Time, time.Time) { return time.Time{}, time.Time{} }
+
+func (n matchNode) bounds() (time.Time, time.Time) {
+	switch n.field {
+	case "after":
+		return n.time, time.Time{}
+	case "before":
+		return time.Time{}, n.time
+	}
+	return time.Time{}, time.Time{}
+}
+
+// filterParser is a recursive descent parser for filter expressions
+type filterParser struct {
+	tokens   []string
+	pos      int
+	location *time.Location
+}
+
+// peek returns the current token or an empty string at the end
+func (p *filterParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+// parseOr parses: and { OR and }
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "OR") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+// parseAnd parses: unary { [AND] unary }
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t == "" || t == ")" || strings.EqualFold(t, "OR") {
+			return left, nil
+		}
+		if strings.EqualFold(t, "AND") {
+			p.pos++
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left: left, right: right}
+	}
+}
+
+// parseUnary parses: NOT unary | ( or ) | condition
+func (p *filterParser) parseUnary() (filterNode, error) {
+	t := p.peek()
+	switch {
+	case t == "":
+		return nil, errors.New("unexpected end of filter")
+	case strings.EqualFold(t, "NOT"):
+		p.pos++
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{node: node}, nil
+	case t == "(":
+		p.pos++
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errors.New("missing closing parenthesis")
+		}
+		p.pos++
+		return node, nil
+	case t == ")":
+		return nil, errors.New("unexpected closing parenthesis")
+	}
+	p.pos++
+	return p.parseCondition(t)
+}
+
+// parseCondition parses a single field:value condition
+func (p *filterParser) parseCondition(t string) (filterNode, error) {
+	field, value, ok := strings.Cut(t, ":")
+	if !ok {
+		return nil, fmt.Errorf("expected field:value, got %q", t)
+	}
+	field = strings.ToLower(field)
+	value = strings.Trim(value, `"`)
+	node := matchNode{field: field, value: value}
+	switch field {
+	case "number", "name", "body":
+	case "direction":
+		node.value = strings.ToLower(value)
+		switch Direction(node.value) {
+		case "in":
+			node.value = string(DirectionIncoming)
+		case "out":
+			node.value = string(DirectionOutgoing)
+		case DirectionIncoming, DirectionOutgoing, DirectionMissed, DirectionRejected:
+		default:
+			return nil, fmt.Errorf("unknown direction %q", value)
+		}
+	case "kind":
+		node.value = strings.ToLower(value)
+		if node.value != KindCall && node.value != KindSms && node.value != KindMms {
+			return nil, fmt.Errorf("unknown kind %q", value)
+		}
+	case "after", "before":
+		d, err := parseFilterTime(value, p.location)
+		if err != nil {
+			return nil, err
+		}
+		node.time = d
+	default:
+		return nil, fmt.Errorf("unknown field %q", field)
+	}
+	return node, nil
+}
+
+// parseFilterTime parses value as date, date with time or RFC3339 timestamp
+func parseFilterTime(value string, location *time.Location) (time.Time, error) {
+	if d, err := time.Parse(time.RFC3339, value); err == nil {
+		return d, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"} {
+		if d, err := time.ParseInLocation(layout, value, location); err == nil {
+			return d, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("could not parse %q as date", value)
+}
+
+// tokenizeFilter splits expr into parentheses, operators and conditions. Double quotes
+// may be used to include blanks and parentheses in values.
+func tokenizeFilter(expr string) ([]string, error) {
+	var tokens []string
+	var current strings.Builder
+	quoted := false
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
+	}
+	for _, r := range expr {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			current.WriteRune(r)
+		case quoted:
+			current.WriteRune(r)
+		case unicode.IsSpace(r):
+			flush()
+		case r == '(' || r == ')':
+			flush()
+			tokens = append(tokens, string(r))
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quote in filter")
+	}
+	flush()
+	return tokens, nil
+}
@@ -0,0 +1,127 @@
+package sbrdata
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseFilter(t *testing.T) {
+	at := time.Date(2023, 5, 17, 12, 0, 0, 0, time.UTC)
+	sms := Event{
+		Kind:        KindSms,
+		Time:        at,
+		Direction:   DirectionIncoming,
+		Numbers:     []string{"+49 171 1234567"},
+		ContactName: "Alice Example",
+		Text:        "See you tomorrow",
+	}
+	call := Event{
+		Kind:        KindCall,
+		Time:        at,
+		Direction:   DirectionMissed,
+		Numbers:     []string{"0301234567"},
+		ContactName: "Bob",
+		Text:        "missed call",
+	}
+	tests := []struct {
+		name      string
+		expr      string
+		wantErr   bool
+		matchSms  bool
+		matchCall bool
+	}{
+		{name: "empty", expr: "", matchSms: true, matchCall: true},
+		{name: "blank", expr: "   ", matchSms: true, matchCall: true},
+		{name: "kind", expr: "kind:sms", matchSms: true},
+		{name: "kind case insensitive", expr: "KIND:Call", matchCall: true},
+		{name: "name", expr: "name:alice", matchSms: true},
+		{name: "number normalized", expr: "number:+491711234567", matchSms: true},
+		{name: "direction", expr: "direction:missed", matchCall: true},
+		{name: "direction short", expr: "direction:in", matchSms: true},
+		{name: "body", expr: `body:"see you"`, matchSms: true},
+		{name: "body does not match calls", expr: "body:missed"},
+		{name: "after inclusive", expr: "after:2023-05-17T12:00:00Z", matchSms: true, matchCall: true},
+		{name: "before exclusive", expr: "before:2023-05-17T12:00:00Z"},
+		{name: "implicit and", expr: "kind:sms name:alice", matchSms: true},
+		{name: "explicit and", expr: "kind:sms AND name:bob"},
+		{name: "or", expr: "name:alice OR name:bob", matchSms: true, matchCall: true},
+		{name: "and binds stronger", expr: "kind:call AND name:alice OR name:bob", matchCall: true},
+		{name: "parentheses", expr: "kind:call AND (name:alice OR name:bob)", matchCall: true},
+		{name: "not", expr: "NOT kind:sms", matchCall: true},
+		{name: "lower case operators", expr: "not kind:sms or kind:sms", matchSms: true, matchCall: true},
+		{name: "quoted parenthesis", expr: `body:"(see"`},
+		{name: "unknown field", expr: "foo:bar", wantErr: true},
+		{name: "unknown kind", expr: "kind:fax", wantErr: true},
+		{name: "unknown direction", expr: "direction:sideways", wantErr: true},
+		{name: "bad date", expr: "after:yesterday", wantErr: true},
+		{name: "missing value separator", expr: "alice", wantErr: true},
+		{name: "unterminated quote", expr: `body:"see you`, wantErr: true},
+		{name: "missing closing parenthesis", expr: "(kind:sms", wantErr: true},
+		{name: "unexpected closing parenthesis", expr: "kind:sms)", wantErr: true},
+		{name: "dangling operator", expr: "kind:sms AND", wantErr: true},
+		{name: "dangling not", expr: "NOT", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ParseFilterInLocation(tt.expr, time.UTC)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error for %q", tt.expr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error for %q: %s", tt.expr, err)
+			}
+			if got := f.MatchEvent(sms); got != tt.matchSms {
+				t.Errorf("sms: got %t, want %t", got, tt.matchSms)
+			}
+			if got := f.MatchEvent(call); got != tt.matchCall {
+				t.Errorf("call: got %t, want %t", got, tt.matchCall)
+			}
+		})
+	}
+}
+
+func TestFilterRange(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("time zone database not available: %s", err)
+	}
+	day := func(year int, month time.Month, d int) time.Time {
+		return time.Date(year, month, d, 0, 0, 0, 0, berlin)
+	}
+	tests := []struct {
+		name     string
+		expr     string
+		from, to time.Time
+	}{
+		{name: "empty", expr: ""},
+		{name: "no dates", expr: "kind:sms name:alice"},
+		{name: "after", expr: "after:2023-01-01", from: day(2023, 1, 1)},
+		{name: "before", expr: "before:2023-02-01", to: day(2023, 2, 1)},
+		{name: "date with time", expr: "after:2023-01-01T08:30", from: time.Date(2023, 1, 1, 8, 30, 0, 0, berlin)},
+		{name: "rfc3339 keeps zone", expr: "after:2023-01-01T00:00:00Z", from: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "and intersects", expr: "after:2023-01-01 before:2023-03-01 after:2023-02-01 before:2023-04-01", from: day(2023, 2, 1), to: day(2023, 3, 1)},
+		{name: "and with condition", expr: "after:2023-01-01 AND kind:sms", from: day(2023, 1, 1)},
+		{name: "or unites", expr: "(after:2023-01-01 before:2023-02-01) OR (after:2023-03-01 before:2023-04-01)", from: day(2023, 1, 1), to: day(2023, 4, 1)},
+		{name: "or with open side", expr: "after:2023-01-01 OR before:2022-01-01"},
+		{name: "or with condition", expr: "after:2023-01-01 OR kind:sms"},
+		{name: "not is unbounded", expr: "NOT after:2023-01-01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ParseFilterInLocation(tt.expr, berlin)
+			if err != nil {
+				t.Fatalf("unexpected error for %q: %s", tt.expr, err)
+			}
+			from, to := f.Range()
+			if !from.Equal(tt.from) {
+				t.Errorf("from: got %s, want %s", from, tt.from)
+			}
+			if !to.Equal(tt.to) {
+				t.Errorf("to: got %s, want %s", to, tt.to)
+			}
+		})
+	}
+}
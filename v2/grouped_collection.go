@@ -3,10 +3,11 @@ package sbrdata
 import (
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"path"
-	"strconv"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 )
@@ -23,161 +24,309 @@ const (
 	// GroupYearly represents a constant value of groupPeriod that indicates yearly grouping.
 	// It is defined as GroupPeriod(2) and is used to differentiate between different grouping options.
 	GroupYearly = GroupPeriod(2)
+	// GroupDaily represents a constant value of groupPeriod that indicates daily grouping.
+	// Collections are persisted as yyyy/mm/dd.json.
+	GroupDaily = GroupPeriod(3)
+	// GroupWeekly represents a constant value of groupPeriod that indicates grouping by ISO week.
+	// Collections are persisted as yyyy/Www.json where yyyy is the ISO year the week belongs to.
+	GroupWeekly = GroupPeriod(4)
+	// GroupQuarterly represents a constant value of groupPeriod that indicates quarterly grouping.
+	// Collections are persisted as yyyy/Qn.json.
+	GroupQuarterly = GroupPeriod(5)
+	// GroupByCounterpart represents a constant value of groupPeriod that indicates grouping by the
+	// normalized number of the counterpart instead of by time. Collections are persisted as counterparts/number.json.
+	GroupByCounterpart = GroupPeriod(6)
 )
 
 const noGroupingMapKey = "collection"
 
 // GroupedCollection saves calls/messages grouped by a period of time
 type GroupedCollection struct {
-	// groupPeriod is either monthly, yearly or none. If none it behaves exactly as like a single Collection
+	// groupPeriod is either daily, weekly, monthly, quarterly, yearly or none. If none it behaves exactly as like a single Collection
 	// if set it will look for multiple collections
 	groupPeriod GroupPeriod
-	// baseDirectory is where the collections are persisted. For monthly, it will be yyyy/mm.json, yearly yyyy.json and none collection.json
+	// groupPeriodSet is true if the group period was passed as option, it must match the manifest then
+	groupPeriodSet bool
+	// baseDirectory is where the collections are persisted. For daily, it will be yyyy/mm/dd.json, weekly yyyy/Www.json,
+	// monthly yyyy/mm.json, quarterly yyyy/Qn.json, yearly yyyy.json, by counterpart counterparts/number.json
+	// and none collection.json
 	baseDirectory string
 	// verbose controls verbosity
 	verbose bool
 	// backup controls whether a backup file is created
 	backup bool
+	// retention decides which backups are kept
+	retention BackupRetention
+	// identity computes the keys used to detect known records, nil functions mean StrictIdentity
+	identity KeyFuncs
+	// merge controls whether known records are updated with data from added records
+	merge MergeMode
 	// collections holds possible collections
 	collections map[string]*Collection
+	// store persists the collections, a JSONStore in baseDirectory unless set by SetStore
+	store Store
+	// blobs stores MMS attachment payloads next to the collections
+	blobs BlobStorage
+	// quarantine holds records that could not be filed because of an unparsable date
+	quarantine *quarantine
+	// timezone is the name of the time zone records are grouped in, persisted in the manifest
+	timezone string
+	// location is the time zone records are grouped in
+	location *time.Location
+	// manifest describes the layout of the base directory
+	manifest *Manifest
+	// manifestDirty is true if the manifest has to be written
+	manifestDirty bool
+	// compression is used for the collection files written by the JSONStore
+	compression Compression
+	// key encrypts the files written by the JSONStore, nil to write them unencrypted
+	key *EncryptionKey
 }
 
-// AddMessages will add all messages (SMS and MMS) to collection which are not yet known
-func (gc *GroupedCollection) AddMessages(messages MessageData) error {
+// AddMessages will add all messages (SMS and MMS) to collection which are not yet known.
+// The returned ImportResult reports per collection key how many messages were added, updated,
+// skipped as duplicates or failed. Errors loading or creating collections abort the import and are returned.
+func (gc *GroupedCollection) AddMessages(messages MessageData) (*ImportResult, error) {
+	result := newImportResult()
 	for _, message := range messages.GetMms() {
-		var c *Collection
-		var err error
-		c, err = gc.getCollection(message.GetDate())
-		if err != nil {
-			return err
-		}
-		if c == nil {
-			log.Printf("could not load collection for grouping %d: %q", gc.groupPeriod, err)
-		} else {
-			err = c.AddMms(message)
-		}
-		if err != nil {
-			log.Printf("could not add mms: %s", err)
+		if err := gc.addMms(result, message); err != nil {
+			return result, err
 		}
 	}
 	for _, message := range messages.GetSms() {
-		var c *Collection
-		var err error
-		c, err = gc.getCollection(message.GetDate())
-		if c == nil {
-			log.Printf("could not load collection for grouping %d: %q", gc.groupPeriod, err)
-		} else {
-			err = c.AddSms(message)
+		if err := gc.addSms(result, message); err != nil {
+			return result, err
 		}
-		if err != nil {
-			log.Printf("could not add mms: %s", err)
+	}
+	return result, nil
+}
+
+// AddMessagesFromReader streams an SMS Backup & Restore message export from r and adds every
+// SMS and MMS not yet known. In contrast to AddMessages the export is never held in memory as a whole.
+func (gc *GroupedCollection) AddMessagesFromReader(r io.Reader) (*ImportResult, error) {
+	result := newImportResult()
+	err := StreamMessages(r, func(message SMS) error {
+		return gc.addSms(result, message)
+	}, func(message MMS) error {
+		return gc.addMms(result, message)
+	})
+	return result, err
+}
+
+// addMms adds a single MMS to the collection matching its date
+func (gc *GroupedCollection) addMms(result *ImportResult, message MMS) error {
+	// the parts are replaced by blob references, the record passed in is left as it is
+	message.Parts.Part = slices.Clone(message.Parts.Part)
+	return gc.importRecord(result, FailedRecord{Kind: KindMms, Mms: &message}, message.Time, func(c *Collection) (recordOutcome, error) {
+		if err := extractParts(gc.blobs, &message); err != nil {
+			return recordDuplicate, err
+		}
+		return c.insertMms(message)
+	})
+}
+
+// addSms adds a single SMS to the collection matching its date
+func (gc *GroupedCollection) addSms(result *ImportResult, message SMS) error {
+	return gc.importRecord(result, FailedRecord{Kind: KindSms, Sms: &message}, message.Time, func(c *Collection) (recordOutcome, error) {
+		return c.insertSms(message)
+	})
+}
+
+// importRecord resolves the collection for the time or counterpart of the record and calls insert with it,
+// counting the outcome in result. Records with an unparsable date are put into quarantine when grouping by time,
+// records failing to insert are recorded as failed. Only errors getting the collection are returned.
+func (gc *GroupedCollection) importRecord(result *ImportResult, record FailedRecord, recordTime func() (time.Time, error), insert func(c *Collection) (recordOutcome, error)) error {
+	var (
+		key string
+		c   *Collection
+		err error
+	)
+	if gc.groupPeriod == GroupByCounterpart {
+		key = counterpartOf(record)
+		c, err = gc.Get(key)
+	} else {
+		var d time.Time
+		d, err = recordTime()
+		if err != nil && gc.groupPeriod != NoGrouping {
+			if gc.verbose {
+				log.Printf("quarantining %s: %s", record.Kind, err)
+			}
+			gc.quarantineRecord(result, QuarantinedRecord{Reason: err.Error(), Call: record.Call, Sms: record.Sms, Mms: record.Mms})
+			return nil
 		}
+		key, c, err = gc.collectionFor(d)
 	}
+	if err != nil {
+		return err
+	}
+	outcome, err := insert(c)
+	if err != nil {
+		record.Key = key
+		result.fail(record, err)
+		if gc.verbose {
+			log.Printf("could not add %s: %s", record.Kind, err)
+		}
+		return nil
+	}
+	result.count(key, outcome)
 	return nil
 }
 
-// getCollection returns a Collection object for the given date.
+// collectionFor returns the key and the Collection object for the given time.
 // If the GroupedCollection has no grouping period, it retrieves the Collection with an empty key.
-// If the GroupedCollection has a grouping period, it creates a key based on the given date
+// If the GroupedCollection has a grouping period, it creates a key based on the given time
 // and retrieves the Collection with that key. If the Collection does not exist, it creates a new one.
-// Returns the Collection object and any error occurred during retrieval or creation.
-func (gc *GroupedCollection) getCollection(date string) (*Collection, error) {
-	var c *Collection
-	var err error
-	var key string
+// Returns the key, the Collection object and any error occurred during retrieval or creation.
+func (gc *GroupedCollection) collectionFor(d time.Time) (string, *Collection, error) {
 	if gc.groupPeriod == NoGrouping {
-		key = ""
-	} else {
-		d := createTimeFromStringUnixEpoch(date)
-		key, err = gc.createKeyAndDirectoryStructure(d)
-		if err != nil {
-			return nil, err
-		}
+		c, err := gc.Get("")
+		return noGroupingMapKey, c, err
 	}
-	c, err = gc.Get(key)
+	key := gc.periodKey(d)
+	c, err := gc.Get(key)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
-	return c, nil
+	return key, c, nil
 }
 
-// createKeyAndDirectoryStructure creates a key for the given time and creates the corresponding directory structure
-// for the grouped collection. If groupPeriod is GroupMonthly, it creates a directory with the year and month as the name.
-// It returns the generated key and any error encountered during the directory creation.
-func (gc *GroupedCollection) createKeyAndDirectoryStructure(d time.Time) (string, error) {
-	key := d.Format("2006")
-	if gc.groupPeriod == GroupMonthly {
-		dir := path.Join(gc.baseDirectory, key)
-		if gc.verbose {
-			log.Printf("potentially creating %q", dir)
-		}
-		err := os.MkdirAll(dir, 0770)
-		if err != nil {
-			return "", err
+// periodKey returns the key of the collection holding records of the given time
+func (gc *GroupedCollection) periodKey(d time.Time) string {
+	d = d.In(gc.location)
+	switch gc.groupPeriod {
+	case GroupDaily:
+		return d.Format("2006/01/02")
+	case GroupWeekly:
+		year, week := d.ISOWeek()
+		return fmt.Sprintf("%04d/W%02d", year, week)
+	case GroupMonthly:
+		return d.Format("2006/01")
+	case GroupQuarterly:
+		return fmt.Sprintf("%s/Q%d", d.Format("2006"), (int(d.Month())+2)/3)
+	}
+	return d.Format("2006")
+}
+
+// Save saves all collections changed since loading to the store, by default as JSON files in the base directory.
+// Quarantined records are saved to unparsed.json, the record counts to the manifest.
+// Collections that were only read, e.g. by AllCalls or a query, are not written again.
+// Saving is all-or-nothing: if an error occurs, nothing is changed and the error is returned.
+// The store is locked while saving. If another process saved since the base directory was opened, saving fails
+// instead of overwriting its changes, open the base directory again and repeat the changes.
+func (gc *GroupedCollection) Save() error {
+	batch := Batch{Documents: make(map[string][]byte)}
+	for _, key := range gc.Keys() {
+		if c := gc.collections[key]; c != nil && c.dirty {
+			batch.Collections = append(batch.Collections, c)
 		}
-		key = d.Format("2006/01")
 	}
-	return key, nil
+	if gc.manifest.GroupPeriod == nil && len(batch.Collections) > 0 {
+		// the default group period of an empty base directory is recorded once collections use it
+		period := gc.groupPeriod
+		gc.manifest.GroupPeriod = &period
+		gc.manifestDirty = true
+	}
+	if err := gc.quarantineDocument(batch.Documents); err != nil {
+		return err
+	}
+	gc.updateCounts()
+	if len(batch.Collections) == 0 && len(batch.Documents) == 0 && !gc.manifestDirty {
+		return nil
+	}
+	if err := gc.store.Lock(); err != nil {
+		return err
+	}
+	if err := gc.saveLocked(batch); err != nil {
+		_ = gc.store.Unlock()
+		return err
+	}
+	for _, c := range batch.Collections {
+		c.dirty = false
+	}
+	gc.quarantine.dirty = false
+	gc.manifestDirty = false
+	return gc.store.Unlock()
 }
 
-// createTimeFromStringUnixEpoch converts a string representation of a Unix epoch timestamp
-// to a time.Time value. It takes a string parameter `date` and returns a time.Time value.
-// If the conversion fails, it logs an error message and returns the zero value of time.Time.
-// The `date` string should be a valid integer representation of a Unix epoch timestamp.
-// The returned time.Time value represents the corresponding time in Unix format.
-func createTimeFromStringUnixEpoch(date string) time.Time {
-	i, err := strconv.Atoi(date)
+// saveLocked checks that no other process saved since gc was opened and saves batch along with the manifest,
+// counting up its revision. The store must be locked.
+func (gc *GroupedCollection) saveLocked(batch Batch) error {
+	if err := gc.checkRevision(); err != nil {
+		return err
+	}
+	gc.manifest.Revision++
+	data, err := gc.manifest.marshal(gc.key)
+	if err == nil {
+		batch.Documents[manifestFile] = data
+		err = gc.store.Save(batch)
+	}
 	if err != nil {
-		log.Printf("could not convert %q to int", date)
+		gc.manifest.Revision--
 	}
-	d := time.Unix(int64(i)/1000, 0)
-	return d
+	return err
 }
 
-// Save saves all the collections in the GroupedCollection to the file system.
-// It iterates over each collection in the collections map and saves it to a JSON file.
-// The file path is constructed using the baseDirectory and the key of the collection.
-// If an error occurs during the saving process, it is returned.
-// If all collections are successfully saved, it returns nil.
-func (gc *GroupedCollection) Save() error {
-	for key, v := range gc.collections {
-		if gc.groupPeriod == GroupMonthly {
-			parts := strings.Split(key, "/")
-			if len(parts) != 2 {
-				log.Printf("expected key of format yyyy/mm, got: %s", key)
-				continue
-			}
-			err := os.MkdirAll(path.Join(gc.baseDirectory, parts[0]), 0700)
-			if err != nil {
-				return err
-			}
-		}
-		if v != nil {
-			err := v.Save(path.Join(gc.baseDirectory, fmt.Sprintf("%s.json", key)))
-			if err != nil {
-				return err
-			}
-		}
+// Delete removes the collection with key from the GroupedCollection and the store
+func (gc *GroupedCollection) Delete(key string) error {
+	if _, ok := gc.collections[key]; !ok {
+		return fmt.Errorf("no collection with key %q", key)
 	}
-	return nil
+	if err := gc.store.Lock(); err != nil {
+		return err
+	}
+	if err := gc.checkRevision(); err != nil {
+		_ = gc.store.Unlock()
+		return err
+	}
+	if err := gc.store.Delete(key); err != nil {
+		_ = gc.store.Unlock()
+		return err
+	}
+	delete(gc.collections, key)
+	delete(gc.manifest.Counts, key)
+	gc.manifestDirty = true
+	return gc.store.Unlock()
 }
 
-// AddCalls will add all calls to collection which are not yet known
-func (gc *GroupedCollection) AddCalls(calls CallsData) error {
+// AddCalls will add all calls to collection which are not yet known.
+// The returned ImportResult reports per collection key how many calls were added, updated,
+// skipped as duplicates or failed. Errors loading or creating collections abort the import and are returned.
+func (gc *GroupedCollection) AddCalls(calls CallsData) (*ImportResult, error) {
+	result := newImportResult()
 	for _, call := range calls.GetCalls() {
-		var c *Collection
-		var err error
-		c, err = gc.getCollection(call.GetDate())
-		if c == nil {
-			log.Printf("could not load collection for grouping %d: %q", gc.groupPeriod, err)
-		} else {
-			err = c.addCalls(call)
+		if err := gc.addCall(result, call); err != nil {
+			return result, err
 		}
-		if err != nil {
-			log.Printf("could not add call: %s", err)
+	}
+	return result, nil
+}
+
+// AddCallsFromReader streams an SMS Backup & Restore call export from r and adds every
+// call not yet known. In contrast to AddCalls the export is never held in memory as a whole.
+func (gc *GroupedCollection) AddCallsFromReader(r io.Reader) (*ImportResult, error) {
+	result := newImportResult()
+	err := StreamCalls(r, func(call Call) error {
+		return gc.addCall(result, call)
+	})
+	return result, err
+}
+
+// addCall adds a single call to the collection matching its date
+func (gc *GroupedCollection) addCall(result *ImportResult, call Call) error {
+	return gc.importRecord(result, FailedRecord{Kind: KindCall, Call: &call}, call.Time, func(c *Collection) (recordOutcome, error) {
+		return c.insertCall(call)
+	})
+}
+
+// Changes returns all fields updated by merging known records in the loaded collections
+func (gc *GroupedCollection) Changes() []FieldChange {
+	var result []FieldChange
+	for _, key := range gc.Keys() {
+		if c := gc.collections[key]; c != nil {
+			result = append(result, c.Changes()...)
 		}
 	}
-	return nil
+	return result
 }
 
 // Keys will return a slice of strings containing all the keys in the GroupedCollection's collections map.
@@ -189,13 +338,153 @@ func (gc *GroupedCollection) Keys() []string {
 	return keys
 }
 
+// KeysBetween returns the keys of all collections whose period overlaps the time range [from, to).
+// A zero from or to leaves the range open on that side. Without grouping the single key is always returned,
+// grouped by counterpart all keys are returned. Keys are returned in ascending order.
+func (gc *GroupedCollection) KeysBetween(from, to time.Time) ([]string, error) {
+	keys := gc.Keys()
+	sort.Strings(keys)
+	if gc.groupPeriod == NoGrouping || gc.groupPeriod == GroupByCounterpart {
+		return keys, nil
+	}
+	result := make([]string, 0, len(keys))
+	for _, key := range keys {
+		start, end, err := gc.keyPeriod(key)
+		if err != nil {
+			return nil, err
+		}
+		if (!to.IsZero() && !start.Before(to)) || (!from.IsZero() && !end.After(from)) {
+			continue
+		}
+		result = append(result, key)
+	}
+	return result, nil
+}
+
+// CallsBetween returns all calls within the time range [from, to). Only collections overlapping
+// the range are loaded. A zero from or to leaves the range open on that side.
+// Calls with an unparsable date are skipped.
+func (gc *GroupedCollection) CallsBetween(from, to time.Time) ([]Call, error) {
+	var result []Call
+	within := rangeCheck(from, to)
+	err := gc.eachCollectionBetween(from, to, func(c *Collection) {
+		for _, call := range c.Calls {
+			if within(call.Time()) {
+				result = append(result, call)
+			}
+		}
+	})
+	return result, err
+}
+
+// SmsBetween returns all SMS messages within the time range [from, to). Only collections overlapping
+// the range are loaded. A zero from or to leaves the range open on that side.
+// Messages with an unparsable date are skipped.
+func (gc *GroupedCollection) SmsBetween(from, to time.Time) ([]SMS, error) {
+	var result []SMS
+	within := rangeCheck(from, to)
+	err := gc.eachCollectionBetween(from, to, func(c *Collection) {
+		for _, sms := range c.Sms {
+			if within(sms.Time()) {
+				result = append(result, sms)
+			}
+		}
+	})
+	return result, err
+}
+
+// MmsBetween returns all MMS messages within the time range [from, to). Only collections overlapping
+// the range are loaded. A zero from or to leaves the range open on that side.
+// Messages with an unparsable date are skipped.
+func (gc *GroupedCollection) MmsBetween(from, to time.Time) ([]MMS, error) {
+	var result []MMS
+	within := rangeCheck(from, to)
+	err := gc.eachCollectionBetween(from, to, func(c *Collection) {
+		for _, mms := range c.Mms {
+			if within(mms.Time()) {
+				result = append(result, mms)
+			}
+		}
+	})
+	return result, err
+}
+
+// eachCollectionBetween calls fn for every collection overlapping the time range [from, to),
+// loading the collections as required
+func (gc *GroupedCollection) eachCollectionBetween(from, to time.Time, fn func(c *Collection)) error {
+	keys, err := gc.KeysBetween(from, to)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		c, err := gc.Get(key)
+		if err != nil {
+			return err
+		}
+		fn(c)
+	}
+	return nil
+}
+
+// rangeCheck returns a function taking the result of a Time accessor and returning true
+// if the time could be parsed and is within [from, to)
+func rangeCheck(from, to time.Time) func(d time.Time, err error) bool {
+	return func(d time.Time, err error) bool {
+		if err != nil {
+			return false
+		}
+		return (from.IsZero() || !d.Before(from)) && (to.IsZero() || d.Before(to))
+	}
+}
+
+// keyPeriod returns the time range [start, end) covered by the collection with the given key
+func (gc *GroupedCollection) keyPeriod(key string) (time.Time, time.Time, error) {
+	switch gc.groupPeriod {
+	case GroupYearly:
+		start, err := time.ParseInLocation("2006", key, gc.location)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid yearly key %q: %w", key, err)
+		}
+		return start, start.AddDate(1, 0, 0), nil
+	case GroupMonthly:
+		start, err := time.ParseInLocation("2006/01", key, gc.location)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid monthly key %q: %w", key, err)
+		}
+		return start, start.AddDate(0, 1, 0), nil
+	case GroupDaily:
+		start, err := time.ParseInLocation("2006/01/02", key, gc.location)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid daily key %q: %w", key, err)
+		}
+		return start, start.AddDate(0, 0, 1), nil
+	case GroupWeekly:
+		var year, week int
+		if _, err := fmt.Sscanf(key, "%04d/W%02d", &year, &week); err != nil || week < 1 || week > 53 {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid weekly key %q", key)
+		}
+		// January 4th is always in the first ISO week
+		start := time.Date(year, time.January, 4, 0, 0, 0, 0, gc.location)
+		start = start.AddDate(0, 0, -((int(start.Weekday())+6)%7)+(week-1)*7)
+		return start, start.AddDate(0, 0, 7), nil
+	case GroupQuarterly:
+		var year, quarter int
+		if _, err := fmt.Sscanf(key, "%04d/Q%d", &year, &quarter); err != nil || quarter < 1 || quarter > 4 {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid quarterly key %q", key)
+		}
+		start := time.Date(year, time.Month(quarter*3-2), 1, 0, 0, 0, 0, gc.location)
+		return start, start.AddDate(0, 3, 0), nil
+	}
+	return time.Time{}, time.Time{}, nil
+}
+
 // AllCalls returns all the calls from the GroupedCollection by iterating
 // over the keys and appending calls from each collection to the result slice.
 // It returns the result slice of calls and any error encountered during the process.
 func (gc *GroupedCollection) AllCalls() ([]Call, error) {
 	var result []Call
 	for _, key := range gc.Keys() {
-		data, err := gc.getCollection(key)
+		data, err := gc.Get(key)
 		if err != nil {
 			return nil, err
 		}
@@ -208,7 +497,7 @@ func (gc *GroupedCollection) AllCalls() ([]Call, error) {
 func (gc *GroupedCollection) AllMms() ([]MMS, error) {
 	var result []MMS
 	for _, key := range gc.Keys() {
-		data, err := gc.getCollection(key)
+		data, err := gc.Get(key)
 		if err != nil {
 			return nil, err
 		}
@@ -223,7 +512,7 @@ func (gc *GroupedCollection) AllMms() ([]MMS, error) {
 func (gc *GroupedCollection) AllSms() ([]SMS, error) {
 	var result []SMS
 	for _, key := range gc.Keys() {
-		data, err := gc.getCollection(key)
+		data, err := gc.Get(key)
 		if err != nil {
 			return nil, err
 		}
@@ -303,8 +592,8 @@ func (gc *GroupedCollection) CustomGrouped(key KeyFuncs) (map[string]*Collection
 }
 
 // Get retrieves a specific collection based on the provided key.
-// If the groupPeriod is NoGrouping, the key must be empty. It returns an error
-// if a key is provided.
+// If the groupPeriod is NoGrouping, the key must be empty or the single key returned by Keys.
+// It returns an error if another key is provided.
 // If the key is empty, it returns an error.
 // If the key exists in the collections map, it checks if the value is nil.
 // If the value is nil, it loads the collection from the file system using the
@@ -315,7 +604,7 @@ func (gc *GroupedCollection) CustomGrouped(key KeyFuncs) (map[string]*Collection
 // This method returns an error if any file or directory operation fails.
 func (gc *GroupedCollection) Get(key string) (*Collection, error) {
 	if gc.groupPeriod == NoGrouping {
-		if key != "" {
+		if key != "" && key != noGroupingMapKey {
 			return nil, errors.New("without grouping no key must be provided")
 		}
 		key = noGroupingMapKey
@@ -325,92 +614,66 @@ func (gc *GroupedCollection) Get(key string) (*Collection, error) {
 	}
 	if v, ok := gc.collections[key]; ok {
 		if v == nil {
-			coll, err := LoadCollection(path.Join(gc.baseDirectory, fmt.Sprintf("%s.json", key)))
+			coll, err := gc.store.Load(key)
+			if errors.Is(err, os.ErrNotExist) && gc.groupPeriod == NoGrouping {
+				coll, err = &Collection{Calls: make([]Call, 0), Sms: make([]SMS, 0), Mms: make([]MMS, 0)}, nil
+			}
 			if err != nil {
 				return nil, err
 			}
+			coll.Key = key
 			if gc.verbose {
 				coll.SetVerbose()
 			}
 			if gc.backup {
 				coll.SetBackup()
 			}
+			coll.SetBackupRetention(gc.retention)
+			coll.SetIdentity(gc.identity)
+			coll.SetMerge(gc.merge)
 			gc.collections[key] = coll
 		}
 	} else {
 		c := &Collection{
-			Key:     key,
-			Calls:   make([]Call, 0),
-			Sms:     make([]SMS, 0),
-			Mms:     make([]MMS, 0),
-			verbose: gc.verbose,
-			backup:  gc.backup,
+			Key:       key,
+			Calls:     make([]Call, 0),
+			Sms:       make([]SMS, 0),
+			Mms:       make([]MMS, 0),
+			verbose:   gc.verbose,
+			backup:    gc.backup,
+			retention: gc.retention,
+			identity:  gc.identity,
+			merge:     gc.merge,
 		}
 		gc.collections[key] = c
 	}
 	return gc.collections[key], nil
 }
 
-// initializeCollections initializes the collections based on the groupPeriod value.
-// If the groupPeriod is NoGrouping, it adds a key of "no" to the collections map with a value of nil.
-// If the groupPeriod is GroupMonthly, it calls the initializeMonthlyGroupedCollections method.
-// If the groupPeriod is GroupYearly, it calls the initializeYearlyGroupedCollections method.
-// If the groupPeriod is not any of the defined values, it returns an error with message "no such grouping available".
-// This method returns an error if any file or directory operation fails.
-func (gc *GroupedCollection) initializeCollections() error {
-	if gc.groupPeriod == NoGrouping {
-		gc.collections[noGroupingMapKey] = nil
-		return nil
-	}
-	if gc.groupPeriod == GroupMonthly {
-		return gc.initializeMonthlyGroupedCollections()
-	}
-	if gc.groupPeriod == GroupYearly {
-		return gc.initializeYearlyGroupedCollections()
-	}
-	return errors.New("no such grouping available")
+// peek returns the collection for key. Collections not loaded yet are read from disk without
+// keeping them in the GroupedCollection, so iterating over all keys does not hold everything in memory.
+// Without grouping, a collection not persisted yet is empty, as for Get.
+func (gc *GroupedCollection) peek(key string) (*Collection, error) {
+	if c, ok := gc.collections[key]; ok && c != nil {
+		return c, nil
+	}
+	c, err := gc.store.Load(key)
+	if errors.Is(err, os.ErrNotExist) && gc.groupPeriod == NoGrouping {
+		return &Collection{Key: key, Calls: make([]Call, 0), Sms: make([]SMS, 0), Mms: make([]MMS, 0)}, nil
+	}
+	return c, err
 }
 
-// initializeYearlyGroupedCollections initializes the yearly grouped collections by reading the items in the base directory.
-// It iterates over each item, and if the item is not a directory, has a name of length 9, and has a ".json" extension,
-// it adds a key of "yyyy" to the collections map with a value of nil.
-// This method returns an error if any file or directory operation fails.
-func (gc *GroupedCollection) initializeYearlyGroupedCollections() error {
-	items, err := os.ReadDir(gc.baseDirectory)
-	if err != nil {
-		return err
-	}
-	for _, item := range items {
-		if !item.IsDir() && len(item.Name()) == 9 && strings.HasSuffix(item.Name(), ".json") {
-			gc.collections[item.Name()[:4]] = nil
-		}
-	}
-	return nil
-}
-
-// initializeMonthlyGroupedCollections initializes the monthly grouped collections by reading the directories and files
-// within the base directory. It iterates over the items in the base directory, and if the item is a directory with a
-// name of length 4, it reads the sub-items in that directory. For each sub-item that is not a directory, has a name
-// of length 7, and has a ".json" extension, it adds a key of "yyyy/mm" to the collections map with a value of nil.
-// This method returns an error if any file or directory operation fails.
-func (gc *GroupedCollection) initializeMonthlyGroupedCollections() error {
-	items, err := os.ReadDir(gc.baseDirectory)
+// initializeCollections adds the keys of all collections persisted in the store for the groupPeriod
+// to the collections map with a value of nil, they are loaded on first access.
+// This method returns an error if the keys cannot be listed.
+func (gc *GroupedCollection) initializeCollections() error {
+	keys, err := gc.store.Keys(gc.groupPeriod)
 	if err != nil {
 		return err
 	}
-	for _, item := range items {
-		if item.IsDir() && len(item.Name()) == 4 { // TODO check for 4 digit number
-			// get json files in directory that are mm.json and add key yyyy/mm to dict
-			subItems, err := os.ReadDir(path.Join(gc.baseDirectory, item.Name()))
-			if err != nil {
-				return err
-			}
-			for _, subItem := range subItems {
-				if !subItem.IsDir() && len(subItem.Name()) == 7 && strings.HasSuffix(subItem.Name(), ".json") {
-					gc.collections[fmt.Sprintf("%s/%s", item.Name(), subItem.Name()[:3])] = nil
-				}
-			}
-		}
+	for _, key := range keys {
+		gc.collections[key] = nil
 	}
 	return nil
 }
@@ -435,14 +698,18 @@ func SetBaseDirectory(baseDirectory string) GroupedCollectionOption {
 
 // SetGroupPeriod sets the grouping period for the GroupedCollection.
 // It takes a parameter period of type GroupPeriod and returns a function of type GroupedCollectionOption.
-// The period must be one of 0, 1 or 2, otherwise an error will be returned.
+// The period must be one of NoGrouping, GroupMonthly, GroupYearly, GroupDaily, GroupWeekly, GroupQuarterly
+// or GroupByCounterpart, otherwise an error will be returned.
+// Without this option the group period recorded in the manifest of the base directory is used, NoGrouping for new
+// base directories. A period contradicting the manifest makes NewGroupedCollection fail.
 // The returned GroupedCollectionOption function sets the groupPeriod field of the GroupedCollection struct.
 func SetGroupPeriod(period GroupPeriod) GroupedCollectionOption {
 	return func(gc *GroupedCollection) error {
-		if uint8(period) > 2 {
-			return errors.New("period must be one of 0, 1 or 2")
+		if period > GroupByCounterpart {
+			return errors.New("period must be one of 0, 1, 2, 3, 4, 5 or 6")
 		}
 		gc.groupPeriod = period
+		gc.groupPeriodSet = true
 		return nil
 	}
 }
@@ -476,6 +743,99 @@ func SetBackup() GroupedCollectionOption {
 	}
 }
 
+// SetBackupRetention sets which backups of a collection file are kept when a new backup is created, see SetBackup.
+// Without this option all backups are kept.
+func SetBackupRetention(retention BackupRetention) GroupedCollectionOption {
+	return func(gc *GroupedCollection) error {
+		if retention.Last < 0 || retention.Daily < 0 || retention.Weekly < 0 || retention.Monthly < 0 {
+			return errors.New("backup retention must not be negative")
+		}
+		gc.retention = retention
+		return nil
+	}
+}
+
+// SetIdentity sets the key functions used to detect records that are already known.
+// Use StrictIdentity, ContentIdentity, NumberIdentity or custom key functions.
+// Without this option StrictIdentity is used, or ContentIdentity when merging.
+func SetIdentity(identity KeyFuncs) GroupedCollectionOption {
+	return func(gc *GroupedCollection) error {
+		if identity.Call == nil || identity.SMS == nil || identity.MMS == nil {
+			return errors.New("identity requires key functions for calls, sms and mms")
+		}
+		gc.identity = identity
+		return nil
+	}
+}
+
+// SetMerge sets how records already known are treated when added again.
+// The mode must be one of MergeNone, MergeFillEmpty or MergePreferNewer, otherwise an error will be returned.
+// Merging together with StrictIdentity is refused when creating the GroupedCollection, as a call or SMS
+// with a changed contact name or status would get a new key and be added again instead of being merged.
+func SetMerge(mode MergeMode) GroupedCollectionOption {
+	return func(gc *GroupedCollection) error {
+		if mode > MergePreferNewer {
+			return errors.New("merge mode must be one of 0, 1 or 2")
+		}
+		gc.merge = mode
+		return nil
+	}
+}
+
+// SetTimezone sets the time zone used to decide which period a record belongs to. It takes an
+// IANA name like Europe/Berlin, UTC or Local for the time zone of the machine. Without this option
+// the time zone recorded in the base directory is used, Local for new base directories.
+// The time zone is persisted in the base directory and a different one is refused afterward.
+func SetTimezone(name string) GroupedCollectionOption {
+	return func(gc *GroupedCollection) error {
+		if _, err := loadLocation(name); err != nil {
+			return fmt.Errorf("invalid time zone %q: %w", name, err)
+		}
+		gc.timezone = name
+		return nil
+	}
+}
+
+// SetStore sets the store persisting the collections. Without this option a JSONStore in the
+// base directory is used, the base directory is not required with a store.
+func SetStore(store Store) GroupedCollectionOption {
+	return func(gc *GroupedCollection) error {
+		if store == nil {
+			return errors.New("store must not be nil")
+		}
+		gc.store = store
+		return nil
+	}
+}
+
+// SetCompression sets the compression of the collection files written to the base directory. Compressed files are
+// detected when loading, no matter which compression is set. Existing collections are converted once they are
+// saved again. The option has no effect on stores passed using SetStore.
+func SetCompression(compression Compression) GroupedCollectionOption {
+	return func(gc *GroupedCollection) error {
+		if compression > CompressionZstd {
+			return fmt.Errorf("no such compression %d", compression)
+		}
+		gc.compression = compression
+		return nil
+	}
+}
+
+// SetEncryptionKey encrypts the collection files, their backups, the quarantined records and the attachments
+// written to the base directory using key, see KeyFromPassphrase and KeyFromFile. Once a key was used, the base
+// directory can only be opened using the same key, use RotateKey to change it. A nil key is ignored.
+// Encryption is not supported by stores passed using SetStore, nor when grouping by counterpart, as the file names
+// would hold the numbers. Attachment files are named by a keyed hash and the record counts in the manifest are
+// encrypted. Not encrypted are the rest of the manifest (schema and tool version, group period, time zone,
+// creation time and revision), the file names telling which periods hold records and when backups were made,
+// the number of attachments and the sizes and modification times of all files.
+func SetEncryptionKey(key *EncryptionKey) GroupedCollectionOption {
+	return func(gc *GroupedCollection) error {
+		gc.key = key
+		return nil
+	}
+}
+
 // NewGroupedCollection creates a new grouped collection
 func NewGroupedCollection(opts ...GroupedCollectionOption) (*GroupedCollection, error) {
 	gc := &GroupedCollection{}
@@ -488,12 +848,42 @@ func NewGroupedCollection(opts ...GroupedCollectionOption) (*GroupedCollection,
 			return nil, err
 		}
 	}
+	var err error
+	if gc.identity, err = effectiveIdentity(gc.identity, gc.merge); err != nil {
+		return nil, err
+	}
 	gc.collections = make(map[string]*Collection)
-	if _, err := os.Stat(gc.baseDirectory); os.IsNotExist(err) {
-		err := os.MkdirAll(gc.baseDirectory, os.ModePerm)
+	if gc.store == nil {
+		store, err := newJSONStore(gc.baseDirectory, gc.verbose)
 		if err != nil {
 			return nil, err
 		}
+		store.SetCompression(gc.compression)
+		store.SetEncryptionKey(gc.key)
+		gc.store = store
+	} else if gc.key != nil {
+		return nil, errors.New("encryption requires the JSON store")
+	}
+	gc.blobs = gc.store.Blobs()
+	// the manifest is read first to check the encryption key before reading anything encrypted
+	if err = gc.loadManifest(); err != nil {
+		return nil, err
+	}
+	if err = gc.loadQuarantine(); err != nil {
+		return nil, err
 	}
-	return gc, gc.initializeCollections()
+	if err = gc.initializeCollections(); err != nil {
+		return nil, err
+	}
+	return gc, gc.applyManifest()
+}
+
+// Location returns the time zone records are grouped in
+func (gc *GroupedCollection) Location() *time.Location {
+	return gc.location
+}
+
+// Blobs returns the store holding the MMS attachment payloads of this GroupedCollection
+func (gc *GroupedCollection) Blobs() BlobStorage {
+	return gc.blobs
 }
@@ -0,0 +1,44 @@
+package sbrdata
+
+import (
+	"testing"
+)
+
+func TestSaveRefusesConcurrentChanges(t *testing.T) {
+	dir := t.TempDir()
+	first := openTestCollection(t, dir)
+	second := openTestCollection(t, dir)
+	if _, err := first.AddCalls(Calls{Call: []Call{{Number: "+491711", Date: may2023}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.AddCalls(Calls{Call: []Call{{Number: "+491712", Date: may2023}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Save(); err == nil {
+		t.Fatal("saving over the changes of another process succeeded")
+	}
+	gc := openTestCollection(t, dir)
+	calls, err := gc.AllCalls()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 || calls[0].Number != "+491711" {
+		t.Fatalf("got %v, want the call saved first", calls)
+	}
+	// saving again after reopening works
+	if _, err = gc.AddCalls(Calls{Call: []Call{{Number: "+491712", Date: may2023}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = gc.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err = gc.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if got := gc.Manifest().Revision; got != 2 {
+		t.Errorf("got revision %d, want 2", got)
+	}
+}
@@ -0,0 +1,181 @@
+package sbrdata
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+const (
+	// IdentityStrict is the name of the identity returned by StrictIdentity
+	IdentityStrict = "strict"
+	// IdentityContent is the name of the identity returned by ContentIdentity
+	IdentityContent = "content"
+	// IdentityNumber is the name of the identity returned by NumberIdentity
+	IdentityNumber = "number"
+)
+
+// StrictIdentity returns key functions treating two calls or SMS as the same record only
+// if all fields are equal. MMS are the same if date and address are equal.
+// This is the default identity of a Collection not merging known records.
+// It cannot be used for merging, as a record with a changed contact name or status
+// gets a new key and would be added again instead of being merged.
+func StrictIdentity() KeyFuncs {
+	return KeyFuncs{
+		Call: strictCallKey,
+		SMS:  strictSmsKey,
+		MMS:  strictMmsKey,
+	}
+}
+
+// strictCallKey is the call key function of StrictIdentity
+func strictCallKey(call Call) (string, error) {
+	return callIdentity(call), nil
+}
+
+// strictSmsKey is the SMS key function of StrictIdentity
+func strictSmsKey(s SMS) (string, error) {
+	return smsIdentity(s), nil
+}
+
+// strictMmsKey is the MMS key function of StrictIdentity
+func strictMmsKey(m MMS) (string, error) {
+	return mmsIdentity(m), nil
+}
+
+// ContentIdentity returns key functions identifying records by date, address, type and a hash of the body.
+// Contact names, readable dates and status flags are ignored, so renaming a contact
+// does not produce duplicates on the next import. This is the default identity when merging.
+func ContentIdentity() KeyFuncs {
+	return KeyFuncs{
+		Call: func(call Call) (string, error) {
+			return joinIdentity(call.Date, call.Number, call.Type, call.Duration), nil
+		},
+		SMS: func(s SMS) (string, error) {
+			return joinIdentity(s.Date, s.Address, s.Type, hashBody(s.Body)), nil
+		},
+		MMS: func(m MMS) (string, error) {
+			var texts []string
+			for _, p := range m.Parts.GetPart() {
+				texts = append(texts, p.AttrText, p.Data, p.Blob)
+			}
+			return joinIdentity(m.Date, m.Address, m.MsgBox, hashBody(strings.Join(texts, "\x00"))), nil
+		},
+	}
+}
+
+// NumberIdentity returns key functions identifying records by date and the normalized
+// number of the counterpart only. See NormalizeNumber for the normalization applied.
+func NumberIdentity() KeyFuncs {
+	return KeyFuncs{
+		Call: func(call Call) (string, error) {
+			return joinIdentity(call.Date, NormalizeNumber(call.Number)), nil
+		},
+		SMS: func(s SMS) (string, error) {
+			return joinIdentity(s.Date, NormalizeNumber(s.Address)), nil
+		},
+		MMS: func(m MMS) (string, error) {
+			return joinIdentity(m.Date, NormalizeNumber(m.Address)), nil
+		},
+	}
+}
+
+// IdentityByName returns the built-in identity with the given name.
+// Valid names are IdentityStrict, IdentityContent and IdentityNumber.
+func IdentityByName(name string) (KeyFuncs, error) {
+	switch name {
+	case IdentityStrict, "":
+		return StrictIdentity(), nil
+	case IdentityContent:
+		return ContentIdentity(), nil
+	case IdentityNumber:
+		return NumberIdentity(), nil
+	}
+	return KeyFuncs{}, fmt.Errorf("no such identity %q", name)
+}
+
+// effectiveIdentity returns the key functions used to detect known records with identity and merge mode.
+// Incomplete key functions fall back to StrictIdentity, or to ContentIdentity when merging.
+// Merging using StrictIdentity is refused, as changed calls and SMS would be added again.
+func effectiveIdentity(identity KeyFuncs, mode MergeMode) (KeyFuncs, error) {
+	if identity.Call == nil || identity.SMS == nil || identity.MMS == nil {
+		if mode != MergeNone {
+			return ContentIdentity(), nil
+		}
+		return StrictIdentity(), nil
+	}
+	if mode != MergeNone && isStrictIdentity(identity) {
+		return KeyFuncs{}, errors.New("merging requires an identity ignoring contact names and status, e.g. content or number")
+	}
+	return identity, nil
+}
+
+// isStrictIdentity returns true if the call or SMS key function of identity is the one of StrictIdentity
+func isStrictIdentity(identity KeyFuncs) bool {
+	return reflect.ValueOf(identity.Call).Pointer() == reflect.ValueOf(strictCallKey).Pointer() ||
+		reflect.ValueOf(identity.SMS).Pointer() == reflect.ValueOf(strictSmsKey).Pointer()
+}
+
+// NormalizeNumber removes all formatting from a phone number, keeping digits and a leading +.
+// A leading 00 is replaced by +. Numbers consisting of something else than digits (e.g. sender
+// names of short messages) are returned lower cased without blanks.
+// Multiple addresses, as used by group MMS, are normalized each and joined using ~.
+func NormalizeNumber(number string) string {
+	if strings.Contains(number, "~") {
+		parts := strings.Split(number, "~")
+		for i := range parts {
+			parts[i] = NormalizeNumber(parts[i])
+		}
+		return strings.Join(parts, "~")
+	}
+	number = strings.TrimSpace(number)
+	var sb strings.Builder
+	for i, r := range number {
+		switch {
+		case r >= '0' && r <= '9':
+			sb.WriteRune(r)
+		case r == '+' && i == 0:
+			sb.WriteRune(r)
+		case r == ' ' || r == '-' || r == '/' || r == '(' || r == ')' || r == '.':
+		default:
+			return strings.ToLower(strings.Join(strings.Fields(number), ""))
+		}
+	}
+	result := sb.String()
+	if strings.HasPrefix(result, "00") {
+		result = "+" + result[2:]
+	}
+	return result
+}
+
+// callIdentity returns a key equal for two calls exactly if all their fields are equal
+func callIdentity(call Call) string {
+	return joinIdentity(call.Number, call.Duration, call.Date, call.Type, call.Presentation,
+		call.SubscriptionID, call.PostDialDigits, call.SubscriptionComponentName, call.ReadableDate,
+		call.ContactName)
+}
+
+// smsIdentity returns a key equal for two SMS exactly if all their fields are equal
+func smsIdentity(s SMS) string {
+	return joinIdentity(s.Protocol, s.Address, s.Date, s.Type, s.Subject, s.Body, s.Toa, s.ScToa,
+		s.ServiceCenter, s.Read, s.Status, s.Locked, s.DateSent, s.SubID, s.ReadableDate, s.ContactName)
+}
+
+// mmsIdentity returns a key built from date and address of the MMS
+func mmsIdentity(m MMS) string {
+	return joinIdentity(m.Date, m.Address)
+}
+
+// joinIdentity builds an identity key from its parts
+func joinIdentity(parts ...string) string {
+	return strings.Join(parts, "\x00")
+}
+
+// hashBody returns a hex encoded sha256 of body
+func hashBody(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,125 @@
+package sbrdata
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	// KindCall marks a record as call
+	KindCall = "call"
+	// KindSms marks a record as SMS
+	KindSms = "sms"
+	// KindMms marks a record as MMS
+	KindMms = "mms"
+)
+
+// recordOutcome is what happened to a single record added to a collection
+type recordOutcome uint8
+
+const (
+	recordAdded = recordOutcome(iota)
+	recordDuplicate
+	recordUpdated
+)
+
+// ImportCounts holds the number of records per outcome of an import
+type ImportCounts struct {
+	// Added is the number of records not known before
+	Added int
+	// Duplicate is the number of records already known and left untouched
+	Duplicate int
+	// Updated is the number of records already known and updated by merging
+	Updated int
+	// Failed is the number of records that could not be imported
+	Failed int
+	// Quarantined is the number of records put into quarantine because of an unparsable date
+	Quarantined int
+}
+
+// FailedRecord is a record that could not be imported along with the reason
+type FailedRecord struct {
+	// Key is the collection key the record was meant for, empty if it could not be determined
+	Key string
+	// Kind is one of KindCall, KindSms or KindMms
+	Kind string
+	// Reason describes why the import failed
+	Reason string
+	// Call is set if Kind is KindCall
+	Call *Call
+	// Sms is set if Kind is KindSms
+	Sms *SMS
+	// Mms is set if Kind is KindMms
+	Mms *MMS
+}
+
+// ImportResult reports the outcome of adding calls or messages to a GroupedCollection
+type ImportResult struct {
+	// Keys holds the counts per collection key. Records put into quarantine are counted
+	// for QuarantineKey.
+	Keys map[string]*ImportCounts
+	// Failed lists all records that could not be imported
+	Failed []FailedRecord
+}
+
+// newImportResult creates an empty ImportResult
+func newImportResult() *ImportResult {
+	return &ImportResult{Keys: make(map[string]*ImportCounts)}
+}
+
+// counts returns the counts for key, creating them if required
+func (ir *ImportResult) counts(key string) *ImportCounts {
+	if _, ok := ir.Keys[key]; !ok {
+		ir.Keys[key] = &ImportCounts{}
+	}
+	return ir.Keys[key]
+}
+
+// count records the outcome of a single record for key
+func (ir *ImportResult) count(key string, outcome recordOutcome) {
+	c := ir.counts(key)
+	switch outcome {
+	case recordAdded:
+		c.Added++
+	case recordDuplicate:
+		c.Duplicate++
+	case recordUpdated:
+		c.Updated++
+	}
+}
+
+// fail records a failed record for key
+func (ir *ImportResult) fail(record FailedRecord, err error) {
+	record.Reason = err.Error()
+	ir.counts(record.Key).Failed++
+	ir.Failed = append(ir.Failed, record)
+}
+
+// SortedKeys returns all keys of the result in ascending order
+func (ir *ImportResult) SortedKeys() []string {
+	keys := make([]string, 0, len(ir.Keys))
+	for k := range ir.Keys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Total sums up the counts of all keys
+func (ir *ImportResult) Total() ImportCounts {
+	var total ImportCounts
+	for _, c := range ir.Keys {
+		total.Added += c.Added
+		total.Duplicate += c.Duplicate
+		total.Updated += c.Updated
+		total.Failed += c.Failed
+		total.Quarantined += c.Quarantined
+	}
+	return total
+}
+
+// String returns a short summary of the result
+func (ir *ImportResult) String() string {
+	t := ir.Total()
+	return fmt.Sprintf("added %d, duplicate %d, updated %d, failed %d, quarantined %d", t.Added, t.Duplicate, t.Updated, t.Failed, t.Quarantined)
+}
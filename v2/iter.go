@@ -0,0 +1,159 @@
+package sbrdata
+
+import (
+	"iter"
+	"sort"
+	"time"
+)
+
+// Record is a single call, SMS or MMS along with its parsed time. Exactly one of Call, Sms and Mms is set.
+type Record struct {
+	// Time is the parsed date of the record, zero if the date could not be parsed
+	Time time.Time
+	// Call is set for calls
+	Call *Call
+	// Sms is set for SMS messages
+	Sms *SMS
+	// Mms is set for MMS messages
+	Mms *MMS
+}
+
+// Kind returns one of KindCall, KindSms or KindMms
+func (r Record) Kind() string {
+	switch {
+	case r.Call != nil:
+		return KindCall
+	case r.Sms != nil:
+		return KindSms
+	}
+	return KindMms
+}
+
+// IterCalls returns an iterator over all calls in chronological order.
+// Collections are loaded one at a time, collections not loaded before are not kept in memory.
+// Iteration stops after yielding an error.
+func (gc *GroupedCollection) IterCalls() iter.Seq2[Call, error] {
+	return func(yield func(Call, error) bool) {
+		for r, err := range gc.IterRecords() {
+			if err != nil {
+				yield(Call{}, err)
+				return
+			}
+			if r.Call != nil && !yield(*r.Call, nil) {
+				return
+			}
+		}
+	}
+}
+
+// IterSms returns an iterator over all SMS messages in chronological order.
+// Collections are loaded one at a time, collections not loaded before are not kept in memory.
+// Iteration stops after yielding an error.
+func (gc *GroupedCollection) IterSms() iter.Seq2[SMS, error] {
+	return func(yield func(SMS, error) bool) {
+		for r, err := range gc.IterRecords() {
+			if err != nil {
+				yield(SMS{}, err)
+				return
+			}
+			if r.Sms != nil && !yield(*r.Sms, nil) {
+				return
+			}
+		}
+	}
+}
+
+// IterMms returns an iterator over all MMS messages in chronological order.
+// Collections are loaded one at a time, collections not loaded before are not kept in memory.
+// Iteration stops after yielding an error.
+func (gc *GroupedCollection) IterMms() iter.Seq2[MMS, error] {
+	return func(yield func(MMS, error) bool) {
+		for r, err := range gc.IterRecords() {
+			if err != nil {
+				yield(MMS{}, err)
+				return
+			}
+			if r.Mms != nil && !yield(*r.Mms, nil) {
+				return
+			}
+		}
+	}
+}
+
+// IterRecords returns an iterator over all calls, SMS and MMS messages in chronological order.
+// Collections are loaded one at a time, collections not loaded before are not kept in memory.
+// Iteration stops after yielding an error.
+func (gc *GroupedCollection) IterRecords() iter.Seq2[Record, error] {
+	return gc.IterRecordsBetween(time.Time{}, time.Time{})
+}
+
+// IterRecordsBetween returns an iterator over all calls, SMS and MMS messages within the time range
+// [from, to) in chronological order. A zero from or to leaves the range open on that side, with
+// both being zero records with unparsable dates are included first.
+// Only collections overlapping the range are loaded, one at a time. Grouped by counterpart, the records
+// of all collections have to be sorted together, so all matching records are held in memory.
+func (gc *GroupedCollection) IterRecordsBetween(from, to time.Time) iter.Seq2[Record, error] {
+	return func(yield func(Record, error) bool) {
+		keys, err := gc.KeysBetween(from, to)
+		if err != nil {
+			yield(Record{}, err)
+			return
+		}
+		unbounded := from.IsZero() && to.IsZero()
+		within := func(r Record) bool {
+			return unbounded || !(r.Time.IsZero() || (!from.IsZero() && r.Time.Before(from)) || (!to.IsZero() && !r.Time.Before(to)))
+		}
+		var pending []Record
+		for _, key := range keys {
+			c, err := gc.peek(key)
+			if err != nil {
+				yield(Record{}, err)
+				return
+			}
+			for _, r := range c.records() {
+				if !within(r) {
+					continue
+				}
+				if gc.groupPeriod == GroupByCounterpart {
+					pending = append(pending, r)
+					continue
+				}
+				if !yield(r, nil) {
+					return
+				}
+			}
+		}
+		sortRecords(pending)
+		for _, r := range pending {
+			if !yield(r, nil) {
+				return
+			}
+		}
+	}
+}
+
+// records returns all calls and messages of the collection sorted by time
+func (c *Collection) records() []Record {
+	result := make([]Record, 0, len(c.Calls)+len(c.Sms)+len(c.Mms))
+	for i := range c.Calls {
+		d, _ := c.Calls[i].Time()
+		result = append(result, Record{Time: d, Call: &c.Calls[i]})
+	}
+	for i := range c.Sms {
+		d, _ := c.Sms[i].Time()
+		result = append(result, Record{Time: d, Sms: &c.Sms[i]})
+	}
+	for i := range c.Mms {
+		d, _ := c.Mms[i].Time()
+		result = append(result, Record{Time: d, Mms: &c.Mms[i]})
+	}
+	sortRecords(result)
+	return result
+}
+
+// sortRecords sorts records by time, keeping the order of records with equal times
+func sortRecords(records []Record) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+}
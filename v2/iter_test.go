@@ -0,0 +1,78 @@
+package sbrdata
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIterEventsBetween(t *testing.T) {
+	day := func(month time.Month, d int) time.Time { return time.Date(2023, month, d, 12, 0, 0, 0, time.UTC) }
+	millis := func(t time.Time) string { return strconv.FormatInt(t.UnixMilli(), 10) }
+	tests := []struct {
+		name   string
+		period GroupPeriod
+	}{
+		{name: "monthly", period: GroupMonthly},
+		{name: "yearly", period: GroupYearly},
+		{name: "by counterpart", period: GroupByCounterpart},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gc, err := NewGroupedCollection(SetBaseDirectory(t.TempDir()), SetGroupPeriod(tt.period), SetTimezone("UTC"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// added out of order, spread over collections and kinds
+			if _, err = gc.AddCalls(Calls{Call: []Call{
+				{Number: "+491711", Date: millis(day(6, 2)), Type: "1"},
+				{Number: "+491712", Date: millis(day(4, 30)), Type: "2"},
+				{Number: "+491713", Date: millis(day(5, 15)), Type: "3"},
+			}}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = gc.AddMessages(Messages{
+				Sms: []SMS{
+					{Address: "+491712", Date: millis(day(5, 31)), Type: "1", Body: "end of may"},
+					{Address: "+491711", Date: millis(day(5, 1)), Type: "2", Body: "first of may"},
+				},
+				Mms: []MMS{{Address: "+491713", Date: millis(day(5, 20)), MsgBox: "1"}},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if err = gc.Save(); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []time.Time
+			var kinds []string
+			for e, err := range gc.IterEventsBetween(day(5, 1), day(6, 1)) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, e.Time)
+				kinds = append(kinds, e.Kind)
+			}
+			want := []time.Time{day(5, 1), day(5, 15), day(5, 20), day(5, 31)}
+			wantKinds := []string{KindSms, KindCall, KindMms, KindSms}
+			if len(got) != len(want) {
+				t.Fatalf("got events at %v, want %v", got, want)
+			}
+			for i := range want {
+				if !got[i].Equal(want[i]) || kinds[i] != wantKinds[i] {
+					t.Errorf("event %d: got %s at %s, want %s at %s", i, kinds[i], got[i], wantKinds[i], want[i])
+				}
+			}
+
+			// stopping early ends the iteration
+			n := 0
+			for range gc.IterEvents() {
+				n++
+				break
+			}
+			if n != 1 {
+				t.Errorf("got %d events after stopping, want 1", n)
+			}
+		})
+	}
+}
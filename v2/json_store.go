@@ -0,0 +1,471 @@
+package sbrdata
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// lockFile is the name of the file in the base directory marking it as locked by a writer
+const lockFile = "sbr.lock"
+
+// JSONStore persists collections as JSON files in a directory tree. For daily grouping it will be yyyy/mm/dd.json,
+// weekly yyyy/Www.json, monthly yyyy/mm.json, quarterly yyyy/Qn.json, yearly yyyy.json, by counterpart
+// counterparts/number.json and without grouping collection.json. Compressed files end in .json.gz or .json.zst
+// instead. Documents are stored as files named like the document, attachments below blobs. Saving is
+// all-or-nothing using a journal, see transaction. With an encryption key, collection files, attachments and all
+// documents but the manifest are encrypted.
+type JSONStore struct {
+	// directory is the base directory
+	directory string
+	// verbose controls verbosity
+	verbose bool
+	// blobs stores MMS attachment payloads in the blobs directory
+	blobs *BlobStore
+	// compression is used for the collection files written
+	compression Compression
+	// key encrypts the files written, nil to write them unencrypted
+	key *EncryptionKey
+	// encryptedOnly refuses unencrypted files, as in encrypted base directories
+	encryptedOnly bool
+}
+
+// NewJSONStore creates a store persisting to directory. The directory is created by the first save, opening a
+// store does not create it. A save interrupted by a crash is completed or rolled back, a base directory still
+// locked by the crashed save is refused until the lock is removed.
+func NewJSONStore(directory string) (*JSONStore, error) {
+	return newJSONStore(directory, false)
+}
+
+// newJSONStore creates a store persisting to directory, logging recovery if verbose is set
+func newJSONStore(directory string, verbose bool) (*JSONStore, error) {
+	if strings.Trim(directory, " \t") == "" {
+		return nil, errors.New("directory must be non empty")
+	}
+	// the blobs directory is created when the first attachment is stored
+	blobs := &BlobStore{directory: path.Join(directory, blobDirectory)}
+	s := &JSONStore{directory: directory, verbose: verbose, blobs: blobs}
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// recover completes or rolls back a save interrupted by a crash. Recovery requires the lock, so the save of
+// another process still committing is left alone. As a crash while saving leaves the lock behind as well, a
+// base directory holding a journal while locked is refused instead of being read half saved.
+func (s *JSONStore) recover() error {
+	if _, err := os.Stat(path.Join(s.directory, journalFile)); err != nil {
+		return nil
+	}
+	if err := s.Lock(); err != nil {
+		return fmt.Errorf("base directory %q holds an unfinished save: %w, the save is completed or rolled back when opening it afterward", s.directory, err)
+	}
+	err := recoverTransaction(s.directory, s.verbose)
+	if unlockErr := s.Unlock(); err == nil {
+		err = unlockErr
+	}
+	return err
+}
+
+// SetCompression sets the compression of the collection files written. Files are read no matter how they are
+// compressed, a collection saved using another compression replaces the file written before.
+func (s *JSONStore) SetCompression(compression Compression) {
+	s.compression = compression
+}
+
+// SetEncryptionKey sets the key to encrypt the files written and decrypt the files read.
+// Unencrypted files are still read unless the base directory is encrypted already, see RotateKey.
+func (s *JSONStore) SetEncryptionKey(key *EncryptionKey) {
+	s.key = key
+	s.blobs.SetEncryptionKey(key)
+}
+
+// Directory returns the base directory of the store
+func (s *JSONStore) Directory() string {
+	return s.directory
+}
+
+// Keys lists the keys of all collection files of the grouping period. Without grouping the single key
+// is always returned. A base directory not created yet has no keys.
+func (s *JSONStore) Keys(period GroupPeriod) ([]string, error) {
+	if period == NoGrouping {
+		return []string{noGroupingMapKey}, nil
+	}
+	if _, err := os.Stat(s.directory); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	keys := make(map[string]bool)
+	var err error
+	switch period {
+	case GroupMonthly:
+		err = s.scanMonthlyKeys(keys)
+	case GroupYearly:
+		err = s.scanYearlyKeys(keys)
+	case GroupDaily:
+		err = s.scanDailyKeys(keys)
+	case GroupWeekly:
+		err = s.scanWeeklyKeys(keys)
+	case GroupQuarterly:
+		err = s.scanQuarterlyKeys(keys)
+	case GroupByCounterpart:
+		err = s.scanCounterpartKeys(keys)
+	default:
+		return nil, errors.New("no such grouping available")
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(keys))
+	for key := range keys {
+		result = append(result, key)
+	}
+	return result, nil
+}
+
+// Load reads the collection with key from its file
+func (s *JSONStore) Load(key string) (*Collection, error) {
+	return loadCollection(s.existingFilePath(key), s.key, s.encryptedOnly)
+}
+
+// Save writes all collections and documents of the batch all-or-nothing. Collections with backups
+// enabled are copied to file.timestamp.json as part of the save, keeping the extension of compressed files.
+// Backups not kept by the retention are removed afterward.
+func (s *JSONStore) Save(batch Batch) error {
+	tx := newTransaction(s.directory)
+	err := s.stage(tx, batch)
+	if err != nil {
+		tx.abort()
+		return err
+	}
+	if err = tx.commit(); err != nil {
+		return err
+	}
+	for _, c := range batch.Collections {
+		if c.backup {
+			if err = pruneBackups(s.existingFilePath(c.Key), c.retention); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// stage writes the new content of all collections and documents of the batch as part of tx
+func (s *JSONStore) stage(tx *transaction, batch Batch) error {
+	for _, c := range batch.Collections {
+		if strings.Contains(c.Key, "/") {
+			err := os.MkdirAll(path.Dir(s.filePath(c.Key)), 0700)
+			if err != nil {
+				return err
+			}
+		}
+		if c.backup {
+			if err := c.doBackup(tx, s.existingFilePath(c.Key)); err != nil {
+				return err
+			}
+		}
+		data, err := c.marshal(s.compression, s.key)
+		if err != nil {
+			return err
+		}
+		if err = tx.write(s.fileName(c.Key), data, 0600); err != nil {
+			return err
+		}
+		// the file written using another compression is replaced
+		for _, name := range s.fileNames(c.Key)[1:] {
+			if err = tx.remove(name); err != nil {
+				return err
+			}
+		}
+	}
+	for name, data := range batch.Documents {
+		var err error
+		switch {
+		case data == nil:
+			err = tx.remove(name)
+		case name == manifestFile:
+			// the manifest is required to open the base directory, it holds no records
+			err = tx.write(name, data, 0600)
+		default:
+			if data, err = seal(data, s.key); err == nil {
+				err = tx.write(name, data, 0600)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the file of the collection with key
+func (s *JSONStore) Delete(key string) error {
+	for _, name := range s.fileNames(key) {
+		err := os.Remove(path.Join(s.directory, name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lock creates the lock file in the base directory, creating the base directory if required. It fails if the file
+// exists, which is the case while another process saves or after a crash. Remove the file if no other process uses
+// the base directory.
+func (s *JSONStore) Lock() error {
+	if err := os.MkdirAll(s.directory, os.ModePerm); err != nil {
+		return err
+	}
+	p := path.Join(s.directory, lockFile)
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		owner, _ := os.ReadFile(p)
+		if len(owner) == 0 {
+			owner = []byte("another process")
+		}
+		return fmt.Errorf("base directory is locked by %s, remove %s if no other process uses it", strings.TrimSpace(string(owner)), p)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "process %d since %s\n", os.Getpid(), time.Now().Format(time.RFC3339))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Unlock removes the lock file from the base directory
+func (s *JSONStore) Unlock() error {
+	err := os.Remove(path.Join(s.directory, lockFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// LoadDocument reads the file name in the base directory, decrypting it if required. The manifest is never encrypted.
+func (s *JSONStore) LoadDocument(name string) ([]byte, error) {
+	data, err := os.ReadFile(path.Join(s.directory, name))
+	if err != nil || name == manifestFile {
+		return data, err
+	}
+	data, err = unsealFrom(data, s.key, s.encryptedOnly)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", name, err)
+	}
+	return data, nil
+}
+
+// Blobs returns the blob store in the blobs directory
+func (s *JSONStore) Blobs() BlobStorage {
+	return s.blobs
+}
+
+// filePath returns the path of the file persisting the collection with the given key
+func (s *JSONStore) filePath(key string) string {
+	return path.Join(s.directory, s.fileName(key))
+}
+
+// fileName returns the path of the file persisting the collection with the given key relative to the base directory
+func (s *JSONStore) fileName(key string) string {
+	return fmt.Sprintf("%s%s", key, s.compression.Extension())
+}
+
+// fileNames returns the paths of all files that may persist the collection with the given key relative to the base
+// directory, starting with the one written using the compression of the store
+func (s *JSONStore) fileNames(key string) []string {
+	result := []string{s.fileName(key)}
+	for _, ext := range collectionExtensions {
+		if ext != s.compression.Extension() {
+			result = append(result, fmt.Sprintf("%s%s", key, ext))
+		}
+	}
+	return result
+}
+
+// existingFilePath returns the path of the file persisting the collection with the given key, which may have
+// been written using another compression. If there is none, the path of a file to write is returned.
+func (s *JSONStore) existingFilePath(key string) string {
+	for _, name := range s.fileNames(key) {
+		p := path.Join(s.directory, name)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return s.filePath(key)
+}
+
+// scanYearlyKeys collects the keys of the yearly grouped collections by reading the items in the base directory.
+// It iterates over each item, and if the item is not a directory and is named yyyy.json, compressed or not,
+// it adds a key of "yyyy" to keys.
+// This method returns an error if any file or directory operation fails.
+func (s *JSONStore) scanYearlyKeys(keys map[string]bool) error {
+	items, err := os.ReadDir(s.directory)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		name, ok := cutCollectionExtension(item.Name())
+		if !item.IsDir() && ok && len(name) == 4 && isDigits(name) {
+			keys[name] = true
+		}
+	}
+	return nil
+}
+
+// scanMonthlyKeys collects the keys of the monthly grouped collections by reading the directories and files
+// within the base directory. It iterates over the items in the base directory, and if the item is a directory with a
+// name of length 4, it reads the sub-items in that directory. For each sub-item that is not a directory and is named
+// mm.json, compressed or not, it adds a key of "yyyy/mm" to keys.
+// This method returns an error if any file or directory operation fails.
+func (s *JSONStore) scanMonthlyKeys(keys map[string]bool) error {
+	items, err := os.ReadDir(s.directory)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if item.IsDir() && len(item.Name()) == 4 && isDigits(item.Name()) {
+			// get json files in directory that are mm.json and add key yyyy/mm to dict
+			subItems, err := os.ReadDir(path.Join(s.directory, item.Name()))
+			if err != nil {
+				return err
+			}
+			for _, subItem := range subItems {
+				name, ok := cutCollectionExtension(subItem.Name())
+				if !subItem.IsDir() && ok && len(name) == 2 && isDigits(name) {
+					keys[fmt.Sprintf("%s/%s", item.Name(), name)] = true
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// scanDailyKeys collects the keys of the daily grouped collections by reading the directories and files
+// within the base directory. For each year directory it reads the month directories, and for each file named dd.json
+// in a month directory it adds a key of "yyyy/mm/dd" to keys.
+// This method returns an error if any file or directory operation fails.
+func (s *JSONStore) scanDailyKeys(keys map[string]bool) error {
+	years, err := subDirectories(s.directory, 4)
+	if err != nil {
+		return err
+	}
+	for _, year := range years {
+		months, err := subDirectories(path.Join(s.directory, year), 2)
+		if err != nil {
+			return err
+		}
+		for _, month := range months {
+			err = s.addCollectionFiles(keys, path.Join(year, month), func(name string) bool {
+				return len(name) == 2 && isDigits(name)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scanWeeklyKeys collects the keys of the weekly grouped collections by reading the year directories
+// within the base directory. For each file named Www.json in a year directory it adds a key of "yyyy/Www"
+// to keys.
+// This method returns an error if any file or directory operation fails.
+func (s *JSONStore) scanWeeklyKeys(keys map[string]bool) error {
+	years, err := subDirectories(s.directory, 4)
+	if err != nil {
+		return err
+	}
+	for _, year := range years {
+		err = s.addCollectionFiles(keys, year, func(name string) bool {
+			return len(name) == 3 && name[0] == 'W' && isDigits(name[1:])
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanQuarterlyKeys collects the keys of the quarterly grouped collections by reading the year directories
+// within the base directory. For each file named Qn.json in a year directory it adds a key of "yyyy/Qn"
+// to keys.
+// This method returns an error if any file or directory operation fails.
+func (s *JSONStore) scanQuarterlyKeys(keys map[string]bool) error {
+	years, err := subDirectories(s.directory, 4)
+	if err != nil {
+		return err
+	}
+	for _, year := range years {
+		err = s.addCollectionFiles(keys, year, func(name string) bool {
+			return len(name) == 2 && name[0] == 'Q' && name[1] >= '1' && name[1] <= '4'
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addCollectionFiles adds a key of "directory/name" to keys for every file named name.json, compressed or not,
+// in directory, relative to the base directory, whose name is accepted by match
+func (s *JSONStore) addCollectionFiles(keys map[string]bool, directory string, match func(name string) bool) error {
+	items, err := os.ReadDir(path.Join(s.directory, directory))
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		name, ok := cutCollectionExtension(item.Name())
+		if !item.IsDir() && ok && match(name) {
+			keys[path.Join(directory, name)] = true
+		}
+	}
+	return nil
+}
+
+// subDirectories returns the names of all directories in directory that consist of length digits
+func subDirectories(directory string, length int) ([]string, error) {
+	items, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, item := range items {
+		if item.IsDir() && len(item.Name()) == length && isDigits(item.Name()) {
+			result = append(result, item.Name())
+		}
+	}
+	return result, nil
+}
+
+// isDigits returns true if s is non-empty and consists of ASCII digits only
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// scanCounterpartKeys collects the keys of the collections grouped by counterpart by reading the
+// counterparts directory within the base directory. For each file named number.json it adds a key of
+// "counterparts/number" to keys.
+// This method returns an error if any file or directory operation fails.
+func (s *JSONStore) scanCounterpartKeys(keys map[string]bool) error {
+	err := s.addCollectionFiles(keys, counterpartDirectory, func(name string) bool {
+		return name != "" && !strings.Contains(name, ".")
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,360 @@
+package sbrdata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// manifestFile is the name of the file in the base directory describing its layout
+const manifestFile = "manifest.json"
+
+// localTimezone is the name persisted for the local time zone of the machine
+const localTimezone = "Local"
+
+// modulePath is used to look up the version of this package in the build information
+const modulePath = "github.com/sascha-andres/sbrdata/v2"
+
+// SchemaVersion is the version of the on-disk layout written by this package
+const SchemaVersion = 1
+
+// schemaUpgrades holds the upgrade from every earlier schema version to the next one, indexed by the
+// version to upgrade from. Upgrades are applied in order when a base directory is opened.
+var schemaUpgrades = []func(gc *GroupedCollection, m *Manifest) error{
+	0: upgradeSchema0,
+}
+
+// Manifest describes how the collections in a base directory are laid out
+type Manifest struct {
+	// SchemaVersion is the version of the on-disk layout
+	SchemaVersion int
+	// GroupPeriod is the grouping used for the collections
+	GroupPeriod *GroupPeriod
+	// Timezone is the IANA name of the time zone used to group records, Local for the
+	// time zone of the machine running the tool
+	Timezone string
+	// CreatedAt is the time the base directory was created, for base directories of earlier
+	// versions the time it was upgraded
+	CreatedAt time.Time
+	// Counts holds the number of records per collection key, as of the last save
+	Counts map[string]RecordCounts `json:",omitempty"`
+	// SealedCounts holds Counts encrypted in encrypted base directories, as they tell how many records each
+	// collection has
+	SealedCounts []byte `json:",omitempty"`
+	// Revision is counted up by every save, to detect saves of other processes while a base directory is open
+	Revision uint64 `json:",omitempty"`
+	// ToolVersion is the version of this package that last wrote the manifest
+	ToolVersion string
+	// KeyCheck is a short text encrypted using the key of an encrypted base directory, to detect wrong keys when
+	// opening it. It is empty if the base directory is not encrypted.
+	KeyCheck []byte `json:",omitempty"`
+	// Unencrypted is set if the base directory was encrypted while holding unencrypted files. They are read until
+	// RotateKey encrypted them, afterward unencrypted files are refused.
+	Unencrypted bool `json:",omitempty"`
+}
+
+// readManifest reads the manifest from the store. If there is none, nil is returned.
+func readManifest(store Store) (*Manifest, error) {
+	data, err := store.LoadDocument(manifestFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", manifestFile, err)
+	}
+	return &m, nil
+}
+
+// marshal returns the JSON to persist the manifest, recording the version of this package.
+// With key, the counts are persisted encrypted as SealedCounts.
+func (m *Manifest) marshal(key *EncryptionKey) ([]byte, error) {
+	m.ToolVersion = toolVersion()
+	persisted := *m
+	persisted.SealedCounts = nil
+	if key != nil {
+		counts, err := json.Marshal(m.Counts)
+		if err != nil {
+			return nil, err
+		}
+		if persisted.SealedCounts, err = key.encrypt(counts); err != nil {
+			return nil, err
+		}
+		persisted.Counts = nil
+	}
+	return json.MarshalIndent(persisted, "", "  ")
+}
+
+// unsealCounts decrypts the counts of a manifest persisted using a key
+func (m *Manifest) unsealCounts(key *EncryptionKey) error {
+	if len(m.SealedCounts) == 0 {
+		return nil
+	}
+	data, err := unseal(m.SealedCounts, key)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", manifestFile, err)
+	}
+	return json.Unmarshal(data, &m.Counts)
+}
+
+// toolVersion returns the version of this package as recorded in the build information
+func toolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Path == modulePath {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
+
+// loadLocation returns the location for a time zone name, handling Local and UTC
+func loadLocation(name string) (*time.Location, error) {
+	if name == localTimezone {
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// Manifest returns a copy of the manifest of the base directory
+func (gc *GroupedCollection) Manifest() Manifest {
+	m := *gc.manifest
+	m.Counts = make(map[string]RecordCounts, len(gc.manifest.Counts))
+	for k, v := range gc.manifest.Counts {
+		m.Counts[k] = v
+	}
+	return m
+}
+
+// loadManifest reads the manifest of the base directory and validates the options against it.
+// A group period not set by options is taken from the manifest. Without a recorded group period, it is detected
+// from the persisted collections, see detectGroupPeriod. In an empty base directory it defaults to NoGrouping,
+// which is only recorded once collections are saved.
+func (gc *GroupedCollection) loadManifest() error {
+	m, err := readManifest(gc.store)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		m = &Manifest{}
+		gc.manifestDirty = true
+	}
+	if m.SchemaVersion > SchemaVersion {
+		return fmt.Errorf("base directory has schema version %d, only up to %d is supported, written by %s", m.SchemaVersion, SchemaVersion, m.ToolVersion)
+	}
+	if m.GroupPeriod != nil {
+		if gc.groupPeriodSet && gc.groupPeriod != *m.GroupPeriod {
+			return fmt.Errorf("base directory is grouped by period %d, refusing to group by %d", *m.GroupPeriod, gc.groupPeriod)
+		}
+		gc.groupPeriod = *m.GroupPeriod
+	} else {
+		detected, found, err := detectGroupPeriod(gc.store)
+		if err != nil {
+			return err
+		}
+		if found && gc.groupPeriodSet && gc.groupPeriod != detected {
+			return fmt.Errorf("base directory holds collections grouped by period %d, refusing to group by %d", detected, gc.groupPeriod)
+		}
+		if found {
+			gc.groupPeriod = detected
+		}
+		if found || gc.groupPeriodSet {
+			period := gc.groupPeriod
+			m.GroupPeriod = &period
+			gc.manifestDirty = true
+		}
+	}
+	gc.manifest = m
+	if err = gc.checkKey(); err != nil {
+		return err
+	}
+	return m.unsealCounts(gc.key)
+}
+
+// applyManifest completes the manifest once the collections are known. The time zone of a base directory is fixed
+// once it has been recorded, as mixing collections grouped in different time zones files records into the wrong
+// period. Base directories of earlier schema versions are upgraded. Changes are written by the next Save, opening a
+// base directory does not write anything.
+func (gc *GroupedCollection) applyManifest() error {
+	m := gc.manifest
+	existing := len(gc.quarantine.Records) > 0
+	for _, c := range gc.collections {
+		existing = existing || c == nil
+	}
+	switch {
+	case m.Timezone == "" && gc.timezone == "":
+		m.Timezone = localTimezone
+		gc.manifestDirty = true
+	case m.Timezone == "":
+		if gc.timezone != localTimezone && existing && gc.groupPeriod != NoGrouping && gc.groupPeriod != GroupByCounterpart {
+			return fmt.Errorf("existing collections were grouped in the local time zone, refusing to group in %s", gc.timezone)
+		}
+		m.Timezone = gc.timezone
+		gc.manifestDirty = true
+	case gc.timezone != "" && gc.timezone != m.Timezone:
+		return fmt.Errorf("base directory is grouped in time zone %s, refusing to group in %s", m.Timezone, gc.timezone)
+	}
+	gc.timezone = m.Timezone
+	var err error
+	gc.location, err = loadLocation(gc.timezone)
+	if err != nil {
+		return err
+	}
+	if gc.retention.Location == nil {
+		gc.retention.Location = gc.location
+	}
+	if m.Counts == nil {
+		m.Counts = make(map[string]RecordCounts)
+	}
+	if m.SchemaVersion == 0 && !existing {
+		m.SchemaVersion = SchemaVersion
+		m.CreatedAt = time.Now()
+	}
+	for m.SchemaVersion < SchemaVersion {
+		if err = schemaUpgrades[m.SchemaVersion](gc, m); err != nil {
+			return fmt.Errorf("could not upgrade base directory from schema version %d: %w", m.SchemaVersion, err)
+		}
+		m.SchemaVersion++
+		gc.manifestDirty = true
+	}
+	return nil
+}
+
+// detectGroupPeriod returns the group period of the collections persisted in store, for base directories written
+// before the manifest recorded it. found is false if there are no collections. An error is returned if collections
+// of more than one group period are found, as the period cannot be told then.
+func detectGroupPeriod(store Store) (period GroupPeriod, found bool, err error) {
+	periods := make(map[GroupPeriod]bool)
+	for _, p := range []GroupPeriod{GroupMonthly, GroupYearly, GroupDaily, GroupWeekly, GroupQuarterly, GroupByCounterpart} {
+		keys, err := store.Keys(p)
+		if err != nil {
+			return 0, false, err
+		}
+		for _, key := range keys {
+			if kp, ok := keyPeriod(key); ok {
+				periods[kp] = true
+			}
+		}
+	}
+	_, err = store.Load(noGroupingMapKey)
+	if err == nil {
+		periods[NoGrouping] = true
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return 0, false, err
+	}
+	if len(periods) > 1 {
+		var names []string
+		for p := range periods {
+			names = append(names, strconv.Itoa(int(p)))
+		}
+		sort.Strings(names)
+		return 0, false, fmt.Errorf("base directory holds collections grouped by periods %s, cannot tell its group period", strings.Join(names, ", "))
+	}
+	for p := range periods {
+		return p, true, nil
+	}
+	return NoGrouping, false, nil
+}
+
+// keyPeriod returns the group period a collection key is formatted for
+func keyPeriod(key string) (GroupPeriod, bool) {
+	if key == noGroupingMapKey {
+		return NoGrouping, true
+	}
+	if name, ok := strings.CutPrefix(key, counterpartDirectory+"/"); ok {
+		return GroupByCounterpart, name != ""
+	}
+	parts := strings.Split(key, "/")
+	if len(parts[0]) != 4 || !isDigits(parts[0]) {
+		return 0, false
+	}
+	switch {
+	case len(parts) == 1:
+		return GroupYearly, true
+	case len(parts) == 2 && len(parts[1]) == 2 && isDigits(parts[1]):
+		return GroupMonthly, true
+	case len(parts) == 3 && len(parts[1]) == 2 && isDigits(parts[1]) && len(parts[2]) == 2 && isDigits(parts[2]):
+		return GroupDaily, true
+	case len(parts) == 2 && len(parts[1]) == 3 && parts[1][0] == 'W' && isDigits(parts[1][1:]):
+		return GroupWeekly, true
+	case len(parts) == 2 && len(parts[1]) == 2 && parts[1][0] == 'Q' && parts[1][1] >= '1' && parts[1][1] <= '4':
+		return GroupQuarterly, true
+	}
+	return 0, false
+}
+
+// updateCounts updates the record counts of all loaded collections and the quarantine in the manifest,
+// marking it to be written if they changed
+func (gc *GroupedCollection) updateCounts() {
+	for key, c := range gc.collections {
+		if c == nil {
+			continue
+		}
+		var counts RecordCounts
+		counts.add(c)
+		if gc.manifest.Counts[key] != counts {
+			gc.manifest.Counts[key] = counts
+			gc.manifestDirty = true
+		}
+	}
+	var quarantined RecordCounts
+	quarantined.add(quarantinedCollection(gc.quarantine.Records))
+	if known, ok := gc.manifest.Counts[QuarantineKey]; known != quarantined || (ok && len(gc.quarantine.Records) == 0) {
+		gc.manifest.Counts[QuarantineKey] = quarantined
+		if len(gc.quarantine.Records) == 0 {
+			delete(gc.manifest.Counts, QuarantineKey)
+		}
+		gc.manifestDirty = true
+	}
+}
+
+// checkRevision returns an error if the manifest in the store has another revision than the one read when gc was
+// opened, as another process saved in between. Saving would overwrite its changes then. The store must be locked.
+func (gc *GroupedCollection) checkRevision() error {
+	m, err := readManifest(gc.store)
+	if err != nil {
+		return err
+	}
+	var revision uint64
+	if m != nil {
+		revision = m.Revision
+	}
+	if revision != gc.manifest.Revision {
+		return errors.New("base directory was changed by another process since it was opened, open it again and repeat the changes")
+	}
+	return nil
+}
+
+// upgradeSchema0 upgrades base directories written before the manifest carried a schema version.
+// The layout of the collections is unchanged, the record counts of all collections are recorded.
+func upgradeSchema0(gc *GroupedCollection, m *Manifest) error {
+	for _, key := range gc.Keys() {
+		c, err := gc.peek(key)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var counts RecordCounts
+		counts.add(c)
+		m.Counts[key] = counts
+	}
+	m.CreatedAt = time.Now()
+	return nil
+}
@@ -0,0 +1,189 @@
+package sbrdata
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+)
+
+// MergeMode controls what happens when a record to add is already known
+type MergeMode uint8
+
+const (
+	// MergeNone skips known records. This is the default.
+	MergeNone = MergeMode(0)
+	// MergeFillEmpty fills fields of a known record which are empty with the value of the
+	// record to add. Fields with a value are never touched.
+	MergeFillEmpty = MergeMode(1)
+	// MergePreferNewer behaves like MergeFillEmpty but additionally takes contact names and
+	// status fields (read, seen, locked, ...) from the record to add, as it is considered to
+	// come from the newer backup. Bodies, subjects and attachments are never overwritten.
+	MergePreferNewer = MergeMode(2)
+)
+
+// FieldChange describes a single field of a known record updated while merging
+type FieldChange struct {
+	// Key is the key of the collection holding the record
+	Key string
+	// Kind is one of call, sms or mms
+	Kind string
+	// Date is the date of the record as found in the backup
+	Date string
+	// Address is the number or address of the counterpart
+	Address string
+	// Field is the name of the changed field
+	Field string
+	// Old is the value before merging
+	Old string
+	// New is the value after merging
+	New string
+}
+
+// String returns a human readable representation of the change
+func (fc FieldChange) String() string {
+	return fmt.Sprintf("%s %s on %s with %s: %s %q => %q", fc.Key, fc.Kind, fc.Date, fc.Address, fc.Field, fc.Old, fc.New)
+}
+
+// newerCallFields are taken from the newer backup using MergePreferNewer
+var newerCallFields = map[string]bool{
+	"ContactName": true,
+}
+
+// newerSmsFields are taken from the newer backup using MergePreferNewer
+var newerSmsFields = map[string]bool{
+	"ContactName": true,
+	"Read":        true,
+	"Status":      true,
+	"Locked":      true,
+}
+
+// newerMmsFields are taken from the newer backup using MergePreferNewer
+var newerMmsFields = map[string]bool{
+	"ContactName":  true,
+	"Read":         true,
+	"Seen":         true,
+	"Locked":       true,
+	"ReadStatus":   true,
+	"AdvancedSeen": true,
+	"St":           true,
+	"Deleted":      true,
+	"FavoriteDate": true,
+}
+
+// mergeRecord merges all string fields of src into dst, which must be pointers to the same struct type,
+// according to mode and returns the changes applied. Fields listed in newer are overwritten for MergePreferNewer.
+func mergeRecord(mode MergeMode, dst, src any, newer map[string]bool) ([]FieldChange, error) {
+	if mode == MergeNone {
+		return nil, nil
+	}
+	d := reflect.ValueOf(dst).Elem()
+	s := reflect.ValueOf(src).Elem()
+	if d.Type() != s.Type() {
+		return nil, errors.New("can only merge records of the same type")
+	}
+	var changes []FieldChange
+	for i := 0; i < d.NumField(); i++ {
+		field := d.Type().Field(i)
+		if field.Type.Kind() != reflect.String {
+			continue
+		}
+		old, value := d.Field(i).String(), s.Field(i).String()
+		if value == "" || old == value {
+			continue
+		}
+		if old != "" && (mode != MergePreferNewer || !newer[field.Name]) {
+			continue
+		}
+		d.Field(i).SetString(value)
+		changes = append(changes, FieldChange{Field: field.Name, Old: old, New: value})
+	}
+	return changes, nil
+}
+
+// mergeCall merges call into the known call with identity key and returns the number of changed fields
+func (c *Collection) mergeCall(key string, call Call) (int, error) {
+	i := c.index.calls[key]
+	changes, err := mergeRecord(c.merge, &c.Calls[i], &call, newerCallFields)
+	if err != nil || len(changes) == 0 {
+		return 0, err
+	}
+	c.recordChanges("call", c.Calls[i].Date, c.Calls[i].Number, changes)
+	newKey, err := c.identity.Call(c.Calls[i])
+	if err != nil {
+		return 0, err
+	}
+	reindex(c.index.calls, key, newKey)
+	return len(changes), nil
+}
+
+// mergeSms merges s into the known SMS with identity key and returns the number of changed fields
+func (c *Collection) mergeSms(key string, s SMS) (int, error) {
+	i := c.index.sms[key]
+	changes, err := mergeRecord(c.merge, &c.Sms[i], &s, newerSmsFields)
+	if err != nil || len(changes) == 0 {
+		return 0, err
+	}
+	c.recordChanges("sms", c.Sms[i].Date, c.Sms[i].Address, changes)
+	newKey, err := c.identity.SMS(c.Sms[i])
+	if err != nil {
+		return 0, err
+	}
+	reindex(c.index.sms, key, newKey)
+	return len(changes), nil
+}
+
+// mergeMms merges m into the known MMS with identity key and returns the number of changed fields.
+// Parts and addresses are only taken over if the known MMS has none.
+func (c *Collection) mergeMms(key string, m MMS) (int, error) {
+	i := c.index.mms[key]
+	known := &c.Mms[i]
+	changes, err := mergeRecord(c.merge, known, &m, newerMmsFields)
+	if err != nil {
+		return 0, err
+	}
+	if c.merge != MergeNone && len(known.Parts.Part) == 0 && len(m.Parts.Part) > 0 {
+		known.Parts = m.Parts
+		changes = append(changes, FieldChange{Field: "Parts", New: fmt.Sprintf("%d parts", len(m.Parts.Part))})
+	}
+	if c.merge != MergeNone && len(known.Addrs.Addr) == 0 && len(m.Addrs.Addr) > 0 {
+		known.Addrs = m.Addrs
+		changes = append(changes, FieldChange{Field: "Addrs", New: fmt.Sprintf("%d addresses", len(m.Addrs.Addr))})
+	}
+	if len(changes) == 0 {
+		return 0, nil
+	}
+	c.recordChanges("mms", known.Date, known.Address, changes)
+	newKey, err := c.identity.MMS(*known)
+	if err != nil {
+		return 0, err
+	}
+	reindex(c.index.mms, key, newKey)
+	return len(changes), nil
+}
+
+// reindex moves the position stored for oldKey to newKey. If another record is known by newKey
+// already, the index is left as it is to keep that record known.
+func reindex(index map[string]int, oldKey, newKey string) {
+	if _, taken := index[newKey]; taken {
+		return
+	}
+	index[newKey] = index[oldKey]
+	delete(index, oldKey)
+}
+
+// recordChanges completes changes with the record information and keeps them for Changes.
+// The collection is marked as changed.
+func (c *Collection) recordChanges(kind, date, address string, changes []FieldChange) {
+	c.dirty = true
+	for _, change := range changes {
+		change.Key = c.Key
+		change.Kind = kind
+		change.Date = date
+		change.Address = address
+		if c.verbose {
+			log.Printf("merging %s", change)
+		}
+		c.changes = append(c.changes, change)
+	}
+}
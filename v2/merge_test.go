@@ -0,0 +1,53 @@
+package sbrdata
+
+import (
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	dir := t.TempDir()
+	gc := openTestCollection(t, dir)
+	if _, err := gc.AddMessages(Messages{Sms: []SMS{{Address: "+491711", Date: may2023, Body: "hello", Read: "0"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gc.Save(); err != nil {
+		t.Fatal(err)
+	}
+	// merging without an identity set uses ContentIdentity, so the changed SMS is known
+	gc = openTestCollection(t, dir, SetMerge(MergePreferNewer))
+	result, err := gc.AddMessages(Messages{Sms: []SMS{{Address: "+491711", Date: may2023, Body: "hello", Read: "1", ContactName: "Alice"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := result.Keys["2023/05"]; c == nil || c.Updated != 1 || c.Added != 0 {
+		t.Fatalf("got %+v, want 1 updated", c)
+	}
+	if n := len(gc.Changes()); n != 2 {
+		t.Errorf("got %d changes, want 2", n)
+	}
+	sms, err := gc.AllSms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sms) != 1 || sms[0].Read != "1" || sms[0].ContactName != "Alice" {
+		t.Errorf("got %+v, want the merged SMS", sms)
+	}
+}
+
+func TestMergeRefusesStrictIdentity(t *testing.T) {
+	if _, err := NewGroupedCollection(SetBaseDirectory(t.TempDir()), SetIdentity(StrictIdentity()), SetMerge(MergeFillEmpty)); err == nil {
+		t.Fatal("merging using StrictIdentity was accepted")
+	}
+}
+
+func TestReindexKeepsOtherRecord(t *testing.T) {
+	index := map[string]int{"a": 0, "b": 1}
+	reindex(index, "a", "b")
+	if index["a"] != 0 || index["b"] != 1 {
+		t.Errorf("got %v, want the index unchanged", index)
+	}
+	reindex(index, "a", "c")
+	if _, ok := index["a"]; ok || index["c"] != 0 {
+		t.Errorf("got %v, want a moved to c", index)
+	}
+}
@@ -0,0 +1,180 @@
+package sbrdata
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+)
+
+// QuarantineKey is the key used in an ImportResult for records put into quarantine
+const QuarantineKey = "unparsed"
+
+// quarantineFile is the name of the file in the base directory holding quarantined records
+const quarantineFile = QuarantineKey + ".json"
+
+// QuarantinedRecord is a record that could not be filed into a collection because its date
+// could not be parsed. Exactly one of Call, Sms and Mms is set.
+type QuarantinedRecord struct {
+	// Reason describes why the record was put into quarantine
+	Reason string
+	// Call is set for calls
+	Call *Call `json:",omitempty"`
+	// Sms is set for SMS messages
+	Sms *SMS `json:",omitempty"`
+	// Mms is set for MMS messages
+	Mms *MMS `json:",omitempty"`
+}
+
+// Kind returns one of KindCall, KindSms or KindMms
+func (qr QuarantinedRecord) Kind() string {
+	return Record{Call: qr.Call, Sms: qr.Sms, Mms: qr.Mms}.Kind()
+}
+
+// clone returns a copy of qr that does not share the record with qr, so it can be changed independently
+func (qr QuarantinedRecord) clone() QuarantinedRecord {
+	if qr.Call != nil {
+		call := *qr.Call
+		qr.Call = &call
+	}
+	if qr.Sms != nil {
+		sms := *qr.Sms
+		qr.Sms = &sms
+	}
+	if qr.Mms != nil {
+		mms := *qr.Mms
+		mms.Parts.Part = slices.Clone(mms.Parts.Part)
+		mms.Addrs.Addr = slices.Clone(mms.Addrs.Addr)
+		qr.Mms = &mms
+	}
+	return qr
+}
+
+// quarantine holds all records with unparsable dates of a GroupedCollection
+type quarantine struct {
+	// Records are the quarantined records
+	Records []QuarantinedRecord
+	// known holds the identities of all quarantined records to not quarantine a record twice
+	known map[string]bool
+	// dirty is true if records were added or removed since loading
+	dirty bool
+}
+
+// Quarantined returns all records that could not be filed because of an unparsable date.
+// Fix them using Refile.
+func (gc *GroupedCollection) Quarantined() []QuarantinedRecord {
+	return gc.quarantine.Records
+}
+
+// Refile tries to file all quarantined records into their collections again. If fix is not nil,
+// it is called for every record before, allowing to correct the date. Records that still cannot be
+// filed stay in quarantine, records fix returns an error for are kept unchanged. Records failing to be
+// added, e.g. because of a damaged attachment, are reported as failed and stay in quarantine as well,
+// with the reason updated. If an error is returned, the record it occurred for and all records not
+// processed yet stay in quarantine unchanged.
+// Alternatively, unparsed.json in the base directory may be edited before calling Refile with a nil fix.
+// Call Save afterward to persist the result.
+func (gc *GroupedCollection) Refile(fix func(r *QuarantinedRecord) error) (*ImportResult, error) {
+	result := newImportResult()
+	records := gc.quarantine.Records
+	gc.quarantine.Records = nil
+	gc.quarantine.known = make(map[string]bool)
+	gc.quarantine.dirty = true
+	for i := range records {
+		r := records[i].clone()
+		if fix != nil {
+			if err := fix(&r); err != nil {
+				gc.quarantineRecord(result, records[i])
+				continue
+			}
+		}
+		failed := len(result.Failed)
+		var err error
+		switch {
+		case r.Call != nil:
+			err = gc.addCall(result, *r.Call)
+		case r.Sms != nil:
+			err = gc.addSms(result, *r.Sms)
+		case r.Mms != nil:
+			err = gc.addMms(result, *r.Mms)
+		}
+		if err != nil {
+			for _, rest := range records[i:] {
+				gc.quarantineRecord(newImportResult(), rest)
+			}
+			return result, err
+		}
+		if len(result.Failed) > failed {
+			r.Reason = result.Failed[failed].Reason
+			gc.quarantineRecord(newImportResult(), r)
+		}
+	}
+	return result, nil
+}
+
+// quarantineRecord adds r to the quarantine unless an equal record is already quarantined
+func (gc *GroupedCollection) quarantineRecord(result *ImportResult, r QuarantinedRecord) {
+	identity := gc.identity
+	if identity.Call == nil || identity.SMS == nil || identity.MMS == nil {
+		identity = StrictIdentity()
+	}
+	var key string
+	var err error
+	switch {
+	case r.Call != nil:
+		key, err = identity.Call(*r.Call)
+	case r.Sms != nil:
+		key, err = identity.SMS(*r.Sms)
+	case r.Mms != nil:
+		key, err = identity.MMS(*r.Mms)
+	}
+	key = r.Kind() + "\x00" + key
+	if err == nil && gc.quarantine.known[key] {
+		result.count(QuarantineKey, recordDuplicate)
+		return
+	}
+	gc.quarantine.known[key] = true
+	gc.quarantine.Records = append(gc.quarantine.Records, r)
+	gc.quarantine.dirty = true
+	result.counts(QuarantineKey).Quarantined++
+}
+
+// loadQuarantine reads the quarantined records from the base directory, if any
+func (gc *GroupedCollection) loadQuarantine() error {
+	gc.quarantine = &quarantine{known: make(map[string]bool)}
+	data, err := gc.store.LoadDocument(quarantineFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, gc.quarantine); err != nil {
+		return err
+	}
+	records := gc.quarantine.Records
+	gc.quarantine.Records = nil
+	for _, r := range records {
+		gc.quarantineRecord(newImportResult(), r)
+	}
+	gc.quarantine.dirty = false
+	return nil
+}
+
+// quarantineDocument adds the quarantined records to documents if they changed. Without any records
+// left, the document is removed.
+func (gc *GroupedCollection) quarantineDocument(documents map[string][]byte) error {
+	if !gc.quarantine.dirty {
+		return nil
+	}
+	if len(gc.quarantine.Records) == 0 {
+		documents[quarantineFile] = nil
+		return nil
+	}
+	data, err := json.MarshalIndent(gc.quarantine, "", "  ")
+	if err != nil {
+		return err
+	}
+	documents[quarantineFile] = data
+	return nil
+}
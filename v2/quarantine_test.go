@@ -0,0 +1,146 @@
+package sbrdata
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// may2023 is a date in May 2023 as found in SMS Backup & Restore exports
+const may2023 = "1683676800000"
+
+// openTestCollection opens a monthly grouped collection in directory, grouped in UTC
+func openTestCollection(t *testing.T, directory string, opts ...GroupedCollectionOption) *GroupedCollection {
+	t.Helper()
+	opts = append([]GroupedCollectionOption{SetBaseDirectory(directory), SetGroupPeriod(GroupMonthly), SetTimezone("UTC")}, opts...)
+	gc, err := NewGroupedCollection(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gc
+}
+
+// fixDate returns a function for Refile setting the date of every record to date
+func fixDate(date string) func(r *QuarantinedRecord) error {
+	return func(r *QuarantinedRecord) error {
+		switch {
+		case r.Call != nil:
+			r.Call.Date = date
+		case r.Sms != nil:
+			r.Sms.Date = date
+		case r.Mms != nil:
+			r.Mms.Date = date
+		}
+		return nil
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	gc := openTestCollection(t, dir)
+	result, err := gc.AddCalls(Calls{Call: []Call{
+		{Number: "+491711", Date: "yesterday"},
+		{Number: "+491712", Date: "yesterday"},
+		{Number: "+491711", Date: "yesterday"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := result.Keys[QuarantineKey]; c == nil || c.Quarantined != 2 || c.Duplicate != 1 {
+		t.Fatalf("got %+v, want 2 quarantined and 1 duplicate", c)
+	}
+	if err = gc.Save(); err != nil {
+		t.Fatal(err)
+	}
+	gc = openTestCollection(t, dir)
+	if n := len(gc.Quarantined()); n != 2 {
+		t.Fatalf("got %d quarantined records after reopening, want 2", n)
+	}
+	if _, err = gc.Refile(nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(gc.Quarantined()); n != 2 {
+		t.Fatalf("got %d quarantined records after refiling unchanged, want 2", n)
+	}
+	result, err = gc.Refile(fixDate(may2023))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := result.Keys["2023/05"]; c == nil || c.Added != 2 {
+		t.Fatalf("got %+v, want 2 added to 2023/05", c)
+	}
+	if err = gc.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, quarantineFile)); !os.IsNotExist(err) {
+		t.Errorf("%s not removed once empty: %v", quarantineFile, err)
+	}
+}
+
+func TestRefileKeepsRecordsOnError(t *testing.T) {
+	dir := t.TempDir()
+	gc := openTestCollection(t, dir)
+	if _, err := gc.AddCalls(Calls{Call: []Call{{Number: "+491711", Date: may2023}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gc.AddCalls(Calls{Call: []Call{{Number: "+491712", Date: "x"}, {Number: "+491713", Date: "y"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gc.Save(); err != nil {
+		t.Fatal(err)
+	}
+	// the collection the records are refiled to cannot be loaded
+	if err := os.WriteFile(filepath.Join(dir, "2023", "05.json"), []byte("{damaged"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	gc = openTestCollection(t, dir)
+	if _, err := gc.Refile(fixDate(may2023)); err == nil {
+		t.Fatal("expected error")
+	}
+	quarantined := gc.Quarantined()
+	if len(quarantined) != 2 {
+		t.Fatalf("got %d quarantined records, want 2", len(quarantined))
+	}
+	for _, r := range quarantined {
+		if r.Call.Date == may2023 {
+			t.Errorf("record of failed refile was changed: %+v", r.Call)
+		}
+	}
+}
+
+func TestRefileKeepsFailedRecords(t *testing.T) {
+	dir := t.TempDir()
+	gc := openTestCollection(t, dir)
+	damaged := MMS{Address: "+491711", Date: "x", Parts: Parts{Part: []Part{
+		{Seq: "0", Ct: "text/plain", Data: "aGVsbG8="},
+		{Seq: "1", Ct: "image/jpeg", Data: "not base64!"},
+	}}}
+	if _, err := gc.AddMessages(Messages{Mms: []MMS{damaged}}); err != nil {
+		t.Fatal(err)
+	}
+	result, err := gc.Refile(fixDate(may2023))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Failed) != 1 {
+		t.Fatalf("got %d failed records, want 1", len(result.Failed))
+	}
+	quarantined := gc.Quarantined()
+	if len(quarantined) != 1 {
+		t.Fatalf("got %d quarantined records, want the failed record", len(quarantined))
+	}
+	r := quarantined[0]
+	if r.Reason != result.Failed[0].Reason {
+		t.Errorf("got reason %q, want %q", r.Reason, result.Failed[0].Reason)
+	}
+	if r.Mms.Parts.Part[0].Data != "aGVsbG8=" || r.Mms.Parts.Part[0].Blob != "" {
+		t.Errorf("parts of the quarantined record were changed: %+v", r.Mms.Parts.Part[0])
+	}
+	if err = gc.Save(); err != nil {
+		t.Fatal(err)
+	}
+	gc = openTestCollection(t, dir)
+	if n := len(gc.Quarantined()); n != 1 {
+		t.Fatalf("got %d quarantined records after saving, want 1", n)
+	}
+}
@@ -0,0 +1,281 @@
+package sbrdata
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// RecordCounts holds the number of records per kind
+type RecordCounts struct {
+	// Calls is the number of calls
+	Calls int
+	// Sms is the number of SMS messages
+	Sms int
+	// Mms is the number of MMS messages
+	Mms int
+}
+
+// String returns the counts in a form suitable for error messages
+func (rc RecordCounts) String() string {
+	return fmt.Sprintf("%d calls, %d sms, %d mms", rc.Calls, rc.Sms, rc.Mms)
+}
+
+// add counts all records of the collection
+func (rc *RecordCounts) add(c *Collection) {
+	rc.Calls += len(c.Calls)
+	rc.Sms += len(c.Sms)
+	rc.Mms += len(c.Mms)
+}
+
+// count returns the number of records per kind in all collections and the quarantine
+func (gc *GroupedCollection) count() (RecordCounts, error) {
+	var result RecordCounts
+	for _, key := range gc.Keys() {
+		c, err := gc.peek(key)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		result.add(c)
+	}
+	result.add(quarantinedCollection(gc.quarantine.Records))
+	return result, nil
+}
+
+// quarantinedCollection returns the quarantined records as collection
+func quarantinedCollection(records []QuarantinedRecord) *Collection {
+	c := &Collection{}
+	for _, r := range records {
+		switch {
+		case r.Call != nil:
+			c.Calls = append(c.Calls, *r.Call)
+		case r.Sms != nil:
+			c.Sms = append(c.Sms, *r.Sms)
+		case r.Mms != nil:
+			c.Mms = append(c.Mms, *r.Mms)
+		}
+	}
+	return c
+}
+
+// Repartition rewrites the base directory of gc using another grouping period. All collections, quarantined records
+// and referenced blobs are written to a staging directory next to the base directory, which is read again to verify
+// the number of records per kind. Only then the directories are swapped by renaming. The old base directory is kept
+// as base.timestamp, including the backups of the collections and files not holding records like sbr.config, which
+// do not fit the new grouping period. Its path is returned, remove it once it is no longer needed.
+// gc must use a JSONStore, which is locked while repartitioning.
+// gc must not be used afterward, open the base directory again using the new grouping period.
+func Repartition(gc *GroupedCollection, period GroupPeriod) (string, error) {
+	if period == gc.groupPeriod {
+		return "", errors.New("base directory is already grouped by this period")
+	}
+	store, ok := gc.store.(*JSONStore)
+	if !ok {
+		return "", errors.New("repartitioning requires a JSON store")
+	}
+	if err := store.Lock(); err != nil {
+		return "", err
+	}
+	defer store.Unlock()
+	if err := gc.checkRevision(); err != nil {
+		return "", err
+	}
+	staging, err := stagingDirectory(store.Directory())
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(staging)
+	if err = gc.repartition(staging, period); err != nil {
+		return "", err
+	}
+	return swapDirectories(store.Directory(), staging)
+}
+
+// repartition writes the records of gc grouped by period into the directory staging and verifies them
+func (gc *GroupedCollection) repartition(staging string, period GroupPeriod) error {
+	expected, err := gc.count()
+	if err != nil {
+		return err
+	}
+	opts := []GroupedCollectionOption{SetBaseDirectory(staging), SetGroupPeriod(period), SetTimezone(gc.timezone), SetMerge(gc.merge), SetCompression(gc.compression), SetEncryptionKey(gc.key)}
+	if gc.identity.Call != nil {
+		opts = append(opts, SetIdentity(gc.identity))
+	}
+	if gc.verbose {
+		opts = append(opts, SetVerbose())
+	}
+	target, err := NewGroupedCollection(opts...)
+	if err != nil {
+		return err
+	}
+	target.manifest.CreatedAt = gc.manifest.CreatedAt
+	for _, key := range gc.Keys() {
+		c, err := gc.peek(key)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err = target.repartitionCollection(c, gc.blobs); err != nil {
+			return err
+		}
+	}
+	if err = target.repartitionCollection(quarantinedCollection(gc.quarantine.Records), gc.blobs); err != nil {
+		return err
+	}
+	// the revision continues, so processes that opened the base directory before notice it was rewritten
+	target.manifest.Revision += gc.manifest.Revision
+	data, err := target.manifest.marshal(target.key)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(filepath.Join(staging, manifestFile), data, 0600); err != nil {
+		return err
+	}
+	return target.verify(expected)
+}
+
+// RepartitionFile writes all records of a single collection file into a new base directory configured by opts,
+// typically SetBaseDirectory and SetGroupPeriod. Attachments referenced by the collection are read from the blobs
+// directory next to the file. The base directory must not exist or be empty. As with Repartition, the records are
+// written to a staging directory first and the number of records per kind is verified before it is renamed.
+func RepartitionFile(file string, opts ...GroupedCollectionOption) error {
+	var settings GroupedCollection
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if err := opt(&settings); err != nil {
+			return err
+		}
+	}
+	source, err := loadCollection(file, settings.key, false)
+	if err != nil {
+		return err
+	}
+	if settings.baseDirectory == "" {
+		return errors.New("base directory must be provided")
+	}
+	if items, err := os.ReadDir(settings.baseDirectory); err == nil && len(items) > 0 {
+		return fmt.Errorf("base directory %q is not empty", settings.baseDirectory)
+	}
+	staging, err := stagingDirectory(settings.baseDirectory)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	target, err := NewGroupedCollection(append(opts, SetBaseDirectory(staging))...)
+	if err != nil {
+		return err
+	}
+	var expected RecordCounts
+	expected.add(source)
+	blobs := &BlobStore{directory: path.Join(filepath.Dir(file), blobDirectory), key: settings.key}
+	if err = target.repartitionCollection(source, blobs); err != nil {
+		return err
+	}
+	if err = target.verify(expected); err != nil {
+		return err
+	}
+	if err = os.Remove(settings.baseDirectory); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.Rename(staging, settings.baseDirectory)
+}
+
+// repartitionCollection adds all records of c to gc, copying the attachments referenced from blobs.
+// Any record that fails to import is returned as error.
+func (gc *GroupedCollection) repartitionCollection(c *Collection, blobs BlobStorage) error {
+	result := newImportResult()
+	for _, call := range c.Calls {
+		if err := gc.addCall(result, call); err != nil {
+			return err
+		}
+	}
+	for _, sms := range c.Sms {
+		if err := gc.addSms(result, sms); err != nil {
+			return err
+		}
+	}
+	if err := copyBlobs(c, blobs, gc.blobs); err != nil {
+		return err
+	}
+	for _, mms := range c.Mms {
+		if err := gc.addMms(result, mms); err != nil {
+			return err
+		}
+	}
+	if len(result.Failed) > 0 {
+		return fmt.Errorf("could not repartition %s: %s", result.Failed[0].Kind, result.Failed[0].Reason)
+	}
+	if gc.verbose {
+		log.Printf("repartitioned collection %q: %s", c.Key, result)
+	}
+	if err := gc.Save(); err != nil {
+		return err
+	}
+	// unload everything to not hold the whole base directory in memory
+	for key := range gc.collections {
+		gc.collections[key] = nil
+	}
+	return nil
+}
+
+// verify reads the base directory of gc again and compares the number of records per kind with expected
+func (gc *GroupedCollection) verify(expected RecordCounts) error {
+	written, err := NewGroupedCollection(SetBaseDirectory(gc.baseDirectory), SetGroupPeriod(gc.groupPeriod), SetEncryptionKey(gc.key))
+	if err != nil {
+		return err
+	}
+	actual, err := written.count()
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return fmt.Errorf("verification of %q failed: expected %s, found %s", gc.baseDirectory, expected, actual)
+	}
+	return nil
+}
+
+// stagingDirectory returns the path of an empty directory next to baseDirectory to build a new base directory in.
+// Leftovers of an interrupted run are removed.
+func stagingDirectory(baseDirectory string) (string, error) {
+	baseDirectory = filepath.Clean(baseDirectory)
+	staging := filepath.Join(filepath.Dir(baseDirectory), fmt.Sprintf(".%s.staging", filepath.Base(baseDirectory)))
+	if err := os.RemoveAll(staging); err != nil {
+		return "", err
+	}
+	return staging, nil
+}
+
+// swapDirectories replaces baseDirectory by staging. The old base directory is renamed to
+// baseDirectory.timestamp first and restored if staging cannot be renamed. The path of the old
+// base directory is returned.
+func swapDirectories(baseDirectory, staging string) (string, error) {
+	baseDirectory = filepath.Clean(baseDirectory)
+	old := fmt.Sprintf("%s.%d", baseDirectory, time.Now().Unix())
+	for i := 1; ; i++ {
+		if _, err := os.Stat(old); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		old = fmt.Sprintf("%s.%d-%d", baseDirectory, time.Now().Unix(), i)
+	}
+	if err := os.Rename(baseDirectory, old); err != nil {
+		return "", err
+	}
+	if err := os.Rename(staging, baseDirectory); err != nil {
+		if restoreErr := os.Rename(old, baseDirectory); restoreErr != nil {
+			return "", fmt.Errorf("could not restore %q from %q: %w", baseDirectory, old, restoreErr)
+		}
+		return "", err
+	}
+	return old, os.Remove(filepath.Join(old, lockFile))
+}
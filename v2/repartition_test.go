@@ -0,0 +1,89 @@
+package sbrdata
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepartition(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	gc := openTestCollection(t, dir, SetBackup())
+	mms := MMS{Address: "+491711", Date: may2023, Parts: Parts{Part: []Part{{Seq: "0", Ct: "image/png", Data: "aGVsbG8="}}}}
+	if _, err := gc.AddMessages(Messages{Mms: []MMS{mms}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gc.AddCalls(Calls{Call: []Call{{Number: "+491711", Date: "x"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gc.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gc.AddCalls(Calls{Call: []Call{{Number: "+491712", Date: may2023}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gc.Save(); err != nil {
+		t.Fatal(err)
+	}
+	backups, err := gc.Backups("2023/05")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("got %d backups, want 1", len(backups))
+	}
+	if err = os.WriteFile(filepath.Join(dir, "sbr.config"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stale := openTestCollection(t, dir)
+
+	old, err := Repartition(openTestCollection(t, dir), GroupYearly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{backups[0].Name, "sbr.config", "2023/05.json"} {
+		if _, err = os.Stat(filepath.Join(old, name)); err != nil {
+			t.Errorf("old base directory lost %s: %s", name, err)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(old, lockFile)); !os.IsNotExist(err) {
+		t.Errorf("old base directory is still locked: %v", err)
+	}
+
+	gc, err = NewGroupedCollection(SetBaseDirectory(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := gc.Manifest(); *m.GroupPeriod != GroupYearly || m.Timezone != "UTC" {
+		t.Errorf("got group period %d in %s, want yearly in UTC", *m.GroupPeriod, m.Timezone)
+	}
+	counts, err := gc.count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (RecordCounts{Calls: 2, Mms: 1}); counts != want {
+		t.Errorf("got %s, want %s", counts, want)
+	}
+	if n := len(gc.Quarantined()); n != 1 {
+		t.Errorf("got %d quarantined records, want 1", n)
+	}
+	c, err := gc.Get("2023")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := gc.Blobs().Get(c.Mms[0].Parts.Part[0].Blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("got attachment %q, want hello", data)
+	}
+
+	// January 2024 is a new collection for the stale collection, only saving can tell the layout changed
+	if _, err = stale.AddCalls(Calls{Call: []Call{{Number: "+491713", Date: "1704067200000"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = stale.Save(); err == nil {
+		t.Error("saving a collection opened before repartitioning succeeded")
+	}
+}
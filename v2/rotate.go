@@ -0,0 +1,151 @@
+package sbrdata
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RotateKey re-encrypts the base directory of gc using newKey: all collection files including their backups,
+// the quarantined records and the attachments. Attachments are renamed to the names used with newKey, see
+// BlobStore.Path. Files not encrypted yet are encrypted as well, a nil newKey removes the encryption. The files are replaced all-or-nothing using a journal and the number of records per
+// kind is verified by opening the base directory using newKey afterward.
+// gc must use a JSONStore, which is locked while rotating.
+// gc must not be used afterward, open the base directory again using newKey.
+func RotateKey(gc *GroupedCollection, newKey *EncryptionKey) error {
+	store, ok := gc.store.(*JSONStore)
+	if !ok {
+		return errors.New("rotating keys requires a JSON store")
+	}
+	if newKey != nil && gc.groupPeriod == GroupByCounterpart {
+		return errCounterpartEncryption
+	}
+	if err := store.Lock(); err != nil {
+		return err
+	}
+	defer store.Unlock()
+	if err := gc.checkRevision(); err != nil {
+		return err
+	}
+	expected, err := gc.count()
+	if err != nil {
+		return err
+	}
+	names, err := encryptedFiles(store.Directory())
+	if err != nil {
+		return err
+	}
+	tx := newTransaction(store.Directory())
+	if err = rotateFiles(tx, names, gc.key, newKey); err != nil {
+		tx.abort()
+		return err
+	}
+	m := gc.Manifest()
+	m.KeyCheck = nil
+	m.Unencrypted = false
+	m.Revision++
+	if newKey != nil {
+		if m.KeyCheck, err = newKey.encrypt(keyCheckText); err != nil {
+			tx.abort()
+			return err
+		}
+	}
+	data, err := m.marshal(newKey)
+	if err == nil {
+		err = tx.write(manifestFile, data, 0600)
+	}
+	if err != nil {
+		tx.abort()
+		return err
+	}
+	if err = tx.commit(); err != nil {
+		return err
+	}
+	if gc.verbose {
+		log.Printf("re-encrypted %d files", len(names))
+	}
+	rotated, err := NewGroupedCollection(SetBaseDirectory(store.Directory()), SetGroupPeriod(gc.groupPeriod), SetEncryptionKey(newKey))
+	if err != nil {
+		return err
+	}
+	actual, err := rotated.count()
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return fmt.Errorf("verification of %q failed: expected %s, found %s", store.Directory(), expected, actual)
+	}
+	return nil
+}
+
+// rotateFiles stages every file in names, relative to the base directory of tx, decrypted using oldKey and
+// encrypted using newKey. Files not encrypted yet are accepted, as they are encrypted now. Attachments are moved
+// to their name for newKey, attachments stored more than once under different names are kept once.
+func rotateFiles(tx *transaction, names []string, oldKey, newKey *EncryptionKey) error {
+	staged := make(map[string]bool, len(names))
+	for _, name := range names {
+		data, err := os.ReadFile(tx.path(name))
+		if err != nil {
+			return err
+		}
+		data, err = unseal(data, oldKey)
+		if err != nil {
+			return fmt.Errorf("could not read %q: %w", name, err)
+		}
+		target := name
+		if strings.HasPrefix(name, blobDirectory+"/") {
+			sum := sha256.Sum256(data)
+			if target, err = blobPath(blobDirectory, hex.EncodeToString(sum[:]), newKey); err != nil {
+				return err
+			}
+			if target != name {
+				if err = tx.remove(name); err != nil {
+					return err
+				}
+			}
+			if staged[target] {
+				continue
+			}
+			if err = os.MkdirAll(filepath.Dir(tx.path(target)), 0700); err != nil {
+				return err
+			}
+		}
+		if data, err = seal(data, newKey); err != nil {
+			return err
+		}
+		if err = tx.write(target, data, 0600); err != nil {
+			return err
+		}
+		staged[target] = true
+	}
+	return nil
+}
+
+// encryptedFiles returns the names of all files in baseDirectory that are encrypted using the key of a base
+// directory, relative to it: collection files, their backups, documents besides the manifest and attachments
+func encryptedFiles(baseDirectory string) ([]string, error) {
+	var result []string
+	err := filepath.WalkDir(baseDirectory, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(baseDirectory, p)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		_, collection := cutCollectionExtension(d.Name())
+		blob := strings.HasPrefix(name, blobDirectory+"/") && !strings.HasSuffix(name, ".tmp")
+		if name != manifestFile && (collection || blob) {
+			result = append(result, name)
+		}
+		return nil
+	})
+	return result, err
+}
@@ -17,6 +17,13 @@ type (
 		GetAttrText() string
 	}
 
+	// PartPayloadData is implemented by parts carrying their payload, inline as found in the backup or as
+	// reference into the blob store. It is kept apart from PartData, type assert a PartData to use it.
+	PartPayloadData interface {
+		GetData() string
+		GetBlob() string
+	}
+
 	// Part is on part
 	Part struct {
 		Seq      string `xml:"seq,attr"`
@@ -30,6 +37,11 @@ type (
 		CttS     string `xml:"ctt_s,attr"`
 		CttT     string `xml:"ctt_t,attr"`
 		AttrText string `xml:"text,attr"`
+		// Data is the base64 encoded payload as found in the backup. It is moved to the blob store
+		// when added to a GroupedCollection
+		Data string `xml:"data,attr" json:",omitempty"`
+		// Blob references the payload in the blob store
+		Blob string `xml:"-" json:",omitempty"`
 	}
 
 	PartsData interface {
@@ -304,6 +316,14 @@ func (p Part) GetAttrText() string {
 	return p.AttrText
 }
 
+func (p Part) GetData() string {
+	return p.Data
+}
+
+func (p Part) GetBlob() string {
+	return p.Blob
+}
+
 func (p Parts) GetPart() []Part {
 	if p.Part == nil {
 		return make([]Part, 0, 0)
@@ -0,0 +1,99 @@
+package sbrdata
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+// ExportSQLite writes all persisted collections, the quarantine, the manifest and the attachments of gc into the new
+// SQLite database file. The database can be opened with any SQLite tool or used as archive by passing a SQLiteStore
+// to SetStore. The database is built next to file and renamed once complete and verified, file must not exist yet.
+// The database is not encrypted, even if the base directory is.
+func ExportSQLite(gc *GroupedCollection, file string) error {
+	if _, err := os.Stat(file); err == nil {
+		return fmt.Errorf("%q exists already", file)
+	}
+	tmp := fmt.Sprintf("%s.tmp", file)
+	// leftover of an interrupted export
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	store, err := NewSQLiteStore(tmp)
+	if err != nil {
+		return err
+	}
+	err = gc.exportTo(store)
+	if closeErr := store.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// exportTo copies the persisted collections, documents and attachments of gc into store and verifies the
+// number of records afterward
+func (gc *GroupedCollection) exportTo(store *SQLiteStore) error {
+	var expected RecordCounts
+	keys := gc.Keys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		c, err := gc.store.Load(key)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		c.Key = key
+		if err = copyBlobs(c, gc.blobs, store); err != nil {
+			return err
+		}
+		if err = store.Save(Batch{Collections: []*Collection{c}}); err != nil {
+			return err
+		}
+		expected.add(c)
+		if gc.verbose {
+			log.Printf("exported collection %q", key)
+		}
+	}
+	quarantined := quarantinedCollection(gc.quarantine.Records)
+	if err := copyBlobs(quarantined, gc.blobs, store); err != nil {
+		return err
+	}
+	expected.add(quarantined)
+	// the database is not encrypted, so the manifest must not ask for a key
+	m := gc.Manifest()
+	m.KeyCheck = nil
+	data, err := m.marshal(nil)
+	if err != nil {
+		return err
+	}
+	documents := map[string][]byte{manifestFile: data}
+	data, err = gc.store.LoadDocument(quarantineFile)
+	if err == nil {
+		documents[quarantineFile] = data
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err = store.Save(Batch{Documents: documents}); err != nil {
+		return err
+	}
+	exported, err := NewGroupedCollection(SetStore(store), SetGroupPeriod(gc.groupPeriod))
+	if err != nil {
+		return err
+	}
+	actual, err := exported.count()
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return fmt.Errorf("verification of %q failed: expected %s, found %s", store.File(), expected, actual)
+	}
+	return nil
+}
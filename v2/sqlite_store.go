@@ -0,0 +1,538 @@
+package sbrdata
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	// pure Go SQLite driver, registered as sqlite, so no cgo is required
+	_ "modernc.org/sqlite"
+)
+
+// sqliteColumn maps a string field of a record to the column holding it
+type sqliteColumn struct {
+	// name is the name of the column, the name of the XML attribute of the field
+	name string
+	// field is the index of the field in the record struct
+	field int
+}
+
+var (
+	callColumns = attributeColumns(reflect.TypeOf(Call{}))
+	smsColumns  = attributeColumns(reflect.TypeOf(SMS{}))
+	mmsColumns  = attributeColumns(reflect.TypeOf(MMS{}))
+	partColumns = attributeColumns(reflect.TypeOf(Part{}))
+	addrColumns = attributeColumns(reflect.TypeOf(Addr{}))
+)
+
+// sqliteIndexes speed up looking up records by time and by counterpart
+var sqliteIndexes = []string{
+	"CREATE INDEX IF NOT EXISTS calls_collection ON calls (collection_key, position)",
+	"CREATE INDEX IF NOT EXISTS calls_date ON calls (date_ms)",
+	"CREATE INDEX IF NOT EXISTS calls_number ON calls (normalized_number)",
+	"CREATE INDEX IF NOT EXISTS sms_collection ON sms (collection_key, position)",
+	"CREATE INDEX IF NOT EXISTS sms_date ON sms (date_ms)",
+	"CREATE INDEX IF NOT EXISTS sms_number ON sms (normalized_number)",
+	"CREATE INDEX IF NOT EXISTS mms_collection ON mms (collection_key, position)",
+	"CREATE INDEX IF NOT EXISTS mms_date ON mms (date_ms)",
+	"CREATE INDEX IF NOT EXISTS mms_number ON mms (normalized_number)",
+	"CREATE INDEX IF NOT EXISTS parts_mms ON parts (mms_id, position)",
+	"CREATE INDEX IF NOT EXISTS addrs_mms ON addrs (mms_id, position)",
+}
+
+// SQLiteStore persists collections in a single SQLite database file. Records are kept in the tables calls, sms
+// and mms, the parts and addresses of MMS in parts and addrs. Every record table has a column per attribute of the
+// SMS Backup & Restore export, named like the attribute, plus the collection key, date_ms with the date as integer
+// (NULL if it cannot be parsed) and normalized_number with the number or address passed through NormalizeNumber.
+// Documents and attachments are stored in the tables documents and blobs. Backups of collections are not
+// supported, copy the database file instead.
+type SQLiteStore struct {
+	// file is the path of the database file
+	file string
+	// db is the connection to the database
+	db *sql.DB
+}
+
+// NewSQLiteStore opens the SQLite database file, creating it and its tables if required.
+// Close the store when done.
+func NewSQLiteStore(file string) (*SQLiteStore, error) {
+	if strings.Trim(file, " \t") == "" {
+		return nil, errors.New("file must be non empty")
+	}
+	db, err := sql.Open("sqlite", fmt.Sprintf("%s?_pragma=busy_timeout(5000)", file))
+	if err != nil {
+		return nil, err
+	}
+	// a single connection serializes all access, SQLite allows only one writer anyway
+	db.SetMaxOpenConns(1)
+	s := &SQLiteStore{file: file, db: db}
+	if err = s.createSchema(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("could not open %q: %w", file, err)
+	}
+	return s, nil
+}
+
+// createSchema creates all tables and indexes not present yet
+func (s *SQLiteStore) createSchema() error {
+	statements := []string{
+		"CREATE TABLE IF NOT EXISTS collections (key TEXT PRIMARY KEY)",
+		createRecordTable("calls", "collection_key TEXT NOT NULL REFERENCES collections (key), position INTEGER NOT NULL, date_ms INTEGER, normalized_number TEXT NOT NULL", callColumns),
+		createRecordTable("sms", "collection_key TEXT NOT NULL REFERENCES collections (key), position INTEGER NOT NULL, date_ms INTEGER, normalized_number TEXT NOT NULL", smsColumns),
+		createRecordTable("mms", "collection_key TEXT NOT NULL REFERENCES collections (key), position INTEGER NOT NULL, date_ms INTEGER, normalized_number TEXT NOT NULL", mmsColumns),
+		createRecordTable("parts", "mms_id INTEGER NOT NULL REFERENCES mms (id), position INTEGER NOT NULL", partColumns),
+		createRecordTable("addrs", "mms_id INTEGER NOT NULL REFERENCES mms (id), position INTEGER NOT NULL", addrColumns),
+		"CREATE TABLE IF NOT EXISTS documents (name TEXT PRIMARY KEY, data BLOB NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS blobs (ref TEXT PRIMARY KEY, data BLOB NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS lock (id INTEGER PRIMARY KEY CHECK (id = 1), owner TEXT NOT NULL)",
+	}
+	for _, statement := range append(statements, sqliteIndexes...) {
+		if _, err := s.db.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// File returns the path of the database file
+func (s *SQLiteStore) File() string {
+	return s.file
+}
+
+// Close closes the database
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// Keys lists the keys of all collections in the database formatted for the grouping period.
+// Without grouping the single key is always returned.
+func (s *SQLiteStore) Keys(period GroupPeriod) ([]string, error) {
+	if period == NoGrouping {
+		return []string{noGroupingMapKey}, nil
+	}
+	rows, err := s.db.Query("SELECT key FROM collections ORDER BY key")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []string
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		if kp, ok := keyPeriod(key); ok && kp == period {
+			result = append(result, key)
+		}
+	}
+	return result, rows.Err()
+}
+
+// Load reads all records of the collection with key in the order they were added
+func (s *SQLiteStore) Load(key string) (*Collection, error) {
+	var known int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM collections WHERE key = ?", key).Scan(&known)
+	if err != nil {
+		return nil, err
+	}
+	if known == 0 {
+		return nil, fmt.Errorf("collection %q: %w", key, os.ErrNotExist)
+	}
+	c := &Collection{Key: key, Calls: make([]Call, 0), Sms: make([]SMS, 0), Mms: make([]MMS, 0)}
+	err = s.query("SELECT "+columnList(callColumns)+" FROM calls WHERE collection_key = ? ORDER BY position", []any{key}, func(rows *sql.Rows) error {
+		var call Call
+		if err := rows.Scan(fieldPointers(&call, callColumns)...); err != nil {
+			return err
+		}
+		c.Calls = append(c.Calls, call)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.query("SELECT "+columnList(smsColumns)+" FROM sms WHERE collection_key = ? ORDER BY position", []any{key}, func(rows *sql.Rows) error {
+		var sms SMS
+		if err := rows.Scan(fieldPointers(&sms, smsColumns)...); err != nil {
+			return err
+		}
+		c.Sms = append(c.Sms, sms)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, s.loadMms(c)
+}
+
+// loadMms reads the MMS of collection c together with their parts and addresses
+func (s *SQLiteStore) loadMms(c *Collection) error {
+	positions := make(map[int64]int)
+	err := s.query("SELECT id, "+columnList(mmsColumns)+" FROM mms WHERE collection_key = ? ORDER BY position", []any{c.Key}, func(rows *sql.Rows) error {
+		var (
+			id  int64
+			mms MMS
+		)
+		if err := rows.Scan(append([]any{&id}, fieldPointers(&mms, mmsColumns)...)...); err != nil {
+			return err
+		}
+		positions[id] = len(c.Mms)
+		c.Mms = append(c.Mms, mms)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = s.query("SELECT mms_id, "+columnList(partColumns)+" FROM parts WHERE mms_id IN (SELECT id FROM mms WHERE collection_key = ?) ORDER BY mms_id, position", []any{c.Key}, func(rows *sql.Rows) error {
+		var (
+			id   int64
+			part Part
+		)
+		if err := rows.Scan(append([]any{&id}, fieldPointers(&part, partColumns)...)...); err != nil {
+			return err
+		}
+		m := &c.Mms[positions[id]]
+		m.Parts.Part = append(m.Parts.Part, part)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.query("SELECT mms_id, "+columnList(addrColumns)+" FROM addrs WHERE mms_id IN (SELECT id FROM mms WHERE collection_key = ?) ORDER BY mms_id, position", []any{c.Key}, func(rows *sql.Rows) error {
+		var (
+			id   int64
+			addr Addr
+		)
+		if err := rows.Scan(append([]any{&id}, fieldPointers(&addr, addrColumns)...)...); err != nil {
+			return err
+		}
+		m := &c.Mms[positions[id]]
+		m.Addrs.Addr = append(m.Addrs.Addr, addr)
+		return nil
+	})
+}
+
+// query runs the query and calls fn for every row
+func (s *SQLiteStore) query(query string, args []any, fn func(rows *sql.Rows) error) error {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Save replaces the records of all collections and writes the documents of the batch in a single transaction
+func (s *SQLiteStore) Save(batch Batch) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = s.stage(tx, batch); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// stage writes the collections and documents of the batch as part of tx
+func (s *SQLiteStore) stage(tx *sql.Tx, batch Batch) error {
+	for _, c := range batch.Collections {
+		if err := deleteRecords(tx, c.Key); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT OR IGNORE INTO collections (key) VALUES (?)", c.Key); err != nil {
+			return err
+		}
+		if err := insertRecords(tx, c); err != nil {
+			return fmt.Errorf("could not save collection %q: %w", c.Key, err)
+		}
+	}
+	for name, data := range batch.Documents {
+		var err error
+		if data == nil {
+			_, err = tx.Exec("DELETE FROM documents WHERE name = ?", name)
+		} else {
+			_, err = tx.Exec("INSERT INTO documents (name, data) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET data = excluded.data", name, data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertRecords inserts all records of c
+func insertRecords(tx *sql.Tx, c *Collection) error {
+	insertCall, err := tx.Prepare(insertStatement("calls", []string{"collection_key", "position", "date_ms", "normalized_number"}, callColumns))
+	if err != nil {
+		return err
+	}
+	defer insertCall.Close()
+	for i, call := range c.Calls {
+		_, err = insertCall.Exec(append([]any{c.Key, i, dateMillis(call.Date), NormalizeNumber(call.Number)}, fieldValues(&call, callColumns)...)...)
+		if err != nil {
+			return err
+		}
+	}
+	insertSms, err := tx.Prepare(insertStatement("sms", []string{"collection_key", "position", "date_ms", "normalized_number"}, smsColumns))
+	if err != nil {
+		return err
+	}
+	defer insertSms.Close()
+	for i, sms := range c.Sms {
+		_, err = insertSms.Exec(append([]any{c.Key, i, dateMillis(sms.Date), NormalizeNumber(sms.Address)}, fieldValues(&sms, smsColumns)...)...)
+		if err != nil {
+			return err
+		}
+	}
+	insertMms, err := tx.Prepare(insertStatement("mms", []string{"collection_key", "position", "date_ms", "normalized_number"}, mmsColumns))
+	if err != nil {
+		return err
+	}
+	defer insertMms.Close()
+	insertPart, err := tx.Prepare(insertStatement("parts", []string{"mms_id", "position"}, partColumns))
+	if err != nil {
+		return err
+	}
+	defer insertPart.Close()
+	insertAddr, err := tx.Prepare(insertStatement("addrs", []string{"mms_id", "position"}, addrColumns))
+	if err != nil {
+		return err
+	}
+	defer insertAddr.Close()
+	for i, mms := range c.Mms {
+		result, err := insertMms.Exec(append([]any{c.Key, i, dateMillis(mms.Date), NormalizeNumber(mms.Address)}, fieldValues(&mms, mmsColumns)...)...)
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		for j, part := range mms.Parts.Part {
+			if _, err = insertPart.Exec(append([]any{id, j}, fieldValues(&part, partColumns)...)...); err != nil {
+				return err
+			}
+		}
+		for j, addr := range mms.Addrs.Addr {
+			if _, err = insertAddr.Exec(append([]any{id, j}, fieldValues(&addr, addrColumns)...)...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteRecords removes all records of the collection with key
+func deleteRecords(tx *sql.Tx, key string) error {
+	statements := []string{
+		"DELETE FROM parts WHERE mms_id IN (SELECT id FROM mms WHERE collection_key = ?)",
+		"DELETE FROM addrs WHERE mms_id IN (SELECT id FROM mms WHERE collection_key = ?)",
+		"DELETE FROM mms WHERE collection_key = ?",
+		"DELETE FROM sms WHERE collection_key = ?",
+		"DELETE FROM calls WHERE collection_key = ?",
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the collection with key and all its records
+func (s *SQLiteStore) Delete(key string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = deleteRecords(tx, key); err == nil {
+		_, err = tx.Exec("DELETE FROM collections WHERE key = ?", key)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Lock records the current process in the table lock. It fails if there is a row already, which is the case while
+// another process saves or after a crash. Delete the row if no other process uses the database.
+func (s *SQLiteStore) Lock() error {
+	owner := fmt.Sprintf("process %d since %s", os.Getpid(), time.Now().Format(time.RFC3339))
+	result, err := s.db.Exec("INSERT OR IGNORE INTO lock (id, owner) VALUES (1, ?)", owner)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 1 {
+		return err
+	}
+	var current string
+	if err = s.db.QueryRow("SELECT owner FROM lock WHERE id = 1").Scan(&current); err != nil || current == "" {
+		current = "another process"
+	}
+	return fmt.Errorf("database is locked by %s, delete the row from table lock in %s if no other process uses it", current, s.file)
+}
+
+// Unlock removes the row from the table lock
+func (s *SQLiteStore) Unlock() error {
+	_, err := s.db.Exec("DELETE FROM lock WHERE id = 1")
+	return err
+}
+
+// LoadDocument reads the document name from the table documents
+func (s *SQLiteStore) LoadDocument(name string) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow("SELECT data FROM documents WHERE name = ?", name).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("document %q: %w", name, os.ErrNotExist)
+	}
+	return data, err
+}
+
+// Blobs returns the store itself, attachments are kept in the table blobs
+func (s *SQLiteStore) Blobs() BlobStorage {
+	return s
+}
+
+// Put stores data in the table blobs, addressed by the sha256 of the content like BlobStore does.
+// If the content is already known, nothing is written.
+func (s *SQLiteStore) Put(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	ref := hex.EncodeToString(sum[:])
+	_, err := s.db.Exec("INSERT OR IGNORE INTO blobs (ref, data) VALUES (?, ?)", ref, data)
+	return ref, err
+}
+
+// Get returns the content stored for ref
+func (s *SQLiteStore) Get(ref string) ([]byte, error) {
+	if len(ref) != sha256.Size*2 {
+		return nil, fmt.Errorf("invalid blob reference %q", ref)
+	}
+	var data []byte
+	err := s.db.QueryRow("SELECT data FROM blobs WHERE ref = ?", ref).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("blob %q: %w", ref, os.ErrNotExist)
+	}
+	return data, err
+}
+
+// Sweep removes all attachments whose reference is not in referenced and returns the number removed
+func (s *SQLiteStore) Sweep(referenced map[string]bool) (int, error) {
+	var unreferenced []string
+	err := s.query("SELECT ref FROM blobs", nil, func(rows *sql.Rows) error {
+		var ref string
+		if err := rows.Scan(&ref); err != nil {
+			return err
+		}
+		if !referenced[ref] {
+			unreferenced = append(unreferenced, ref)
+		}
+		return nil
+	})
+	if err != nil || len(unreferenced) == 0 {
+		return 0, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	for _, ref := range unreferenced {
+		if _, err = tx.Exec("DELETE FROM blobs WHERE ref = ?", ref); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(unreferenced), nil
+}
+
+// attributeColumns returns a column for every string field of the record type t. Columns are named like the
+// XML attribute, character data is stored as text and fields not part of the XML by their lower cased name.
+func attributeColumns(t reflect.Type) []sqliteColumn {
+	var result []sqliteColumn
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Type.Kind() != reflect.String {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("xml"), ",")
+		switch {
+		case f.Tag.Get("xml") == ",chardata":
+			name = "text"
+		case name == "-" || name == "":
+			name = strings.ToLower(f.Name)
+		}
+		result = append(result, sqliteColumn{name: name, field: i})
+	}
+	return result
+}
+
+// createRecordTable returns the statement creating table with an integer id, the columns in keyColumns and
+// a text column for each of columns
+func createRecordTable(table, keyColumns string, columns []sqliteColumn) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "CREATE TABLE IF NOT EXISTS %s (id INTEGER PRIMARY KEY, %s", table, keyColumns)
+	for _, c := range columns {
+		fmt.Fprintf(&sb, ", %q TEXT NOT NULL", c.name)
+	}
+	sb.WriteString(")")
+	return sb.String()
+}
+
+// insertStatement returns the statement inserting a row with the values of keyColumns followed by columns into table
+func insertStatement(table string, keyColumns []string, columns []sqliteColumn) string {
+	n := len(keyColumns) + len(columns)
+	return fmt.Sprintf("INSERT INTO %s (%s, %s) VALUES (%s)", table, strings.Join(keyColumns, ", "), columnList(columns), strings.TrimSuffix(strings.Repeat("?, ", n), ", "))
+}
+
+// columnList returns the quoted names of columns separated by comma
+func columnList(columns []sqliteColumn) string {
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = fmt.Sprintf("%q", c.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// fieldValues returns the values of the fields of the record pointed to by record for columns
+func fieldValues(record any, columns []sqliteColumn) []any {
+	v := reflect.ValueOf(record).Elem()
+	result := make([]any, len(columns))
+	for i, c := range columns {
+		result[i] = v.Field(c.field).String()
+	}
+	return result
+}
+
+// fieldPointers returns pointers to the fields of the record pointed to by record for columns, to scan a row into
+func fieldPointers(record any, columns []sqliteColumn) []any {
+	v := reflect.ValueOf(record).Elem()
+	result := make([]any, len(columns))
+	for i, c := range columns {
+		result[i] = v.Field(c.field).Addr().Interface()
+	}
+	return result
+}
+
+// dateMillis returns date as integer for the date_ms column, nil if it cannot be parsed
+func dateMillis(date string) any {
+	t, err := parseUnixEpochMillis(date)
+	if err != nil {
+		return nil
+	}
+	return t.UnixMilli()
+}
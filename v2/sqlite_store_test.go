@@ -0,0 +1,130 @@
+package sbrdata
+
+import (
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// openSQLiteCollection opens a monthly grouped collection in UTC stored in the SQLite database file
+func openSQLiteCollection(t *testing.T, file string) (*GroupedCollection, *SQLiteStore) {
+	t.Helper()
+	store, err := NewSQLiteStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	gc, err := NewGroupedCollection(SetStore(store), SetGroupPeriod(GroupMonthly), SetTimezone("UTC"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gc, store
+}
+
+func TestSQLiteStoreRoundTrip(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sbr.db")
+	gc, store := openSQLiteCollection(t, file)
+	if _, err := gc.AddCalls(Calls{Call: []Call{
+		{Number: "+491711", Date: may2023, Duration: "42", Type: "1", ContactName: "Alice", ReadableDate: "May 10, 2023"},
+		{Number: "+491712", Date: "1704067200000", Type: "3"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gc.AddMessages(Messages{
+		Sms: []SMS{{Address: "+491711", Date: may2023, Type: "1", Body: "line\nbreak & ümlaut", Read: "1"}},
+		Mms: []MMS{{Address: "+491711~+491712", Date: may2023, MsgBox: "1",
+			Parts: Parts{Part: []Part{{Seq: "0", Ct: "text/plain", AttrText: "hi"}, {Seq: "1", Ct: "image/png", Data: "aGVsbG8="}}},
+			Addrs: Addrs{Addr: []Addr{{Address: "+491711", Type: "137"}, {Address: "+491712", Type: "151"}}},
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gc.Save(); err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{"2023/05", "2024/01"}
+	saved := make(map[string]*Collection)
+	for _, key := range keys {
+		c, err := gc.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved[key] = c
+	}
+	_ = store.Close()
+
+	gc, store = openSQLiteCollection(t, file)
+	for _, key := range keys {
+		c, err := gc.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.Calls, saved[key].Calls) || !reflect.DeepEqual(c.Sms, saved[key].Sms) ||
+			!reflect.DeepEqual(c.Mms, saved[key].Mms) {
+			t.Errorf("%s: got %+v, want %+v", key, c, saved[key])
+		}
+	}
+	mms := saved["2023/05"].Mms
+	if len(mms) != 1 || len(mms[0].Parts.Part) != 2 || len(mms[0].Addrs.Addr) != 2 {
+		t.Fatalf("got %+v, want an MMS with two parts and addresses", mms)
+	}
+	data, err := gc.Blobs().Get(mms[0].Parts.Part[1].Blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("got attachment %q, want hello", data)
+	}
+
+	// another grouping is not mistaken for the grouping of the database
+	if err = store.Save(Batch{Collections: []*Collection{{Key: "2023"}}}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		period GroupPeriod
+		want   []string
+	}{
+		{period: GroupMonthly, want: []string{"2023/05", "2024/01"}},
+		{period: GroupYearly, want: []string{"2023"}},
+		{period: GroupDaily},
+		{period: NoGrouping, want: []string{noGroupingMapKey}},
+	}
+	for _, tt := range tests {
+		keys, err := store.Keys(tt.period)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(keys, tt.want) {
+			t.Errorf("period %d: got keys %v, want %v", tt.period, keys, tt.want)
+		}
+	}
+}
+
+func TestSQLiteStoreSweep(t *testing.T) {
+	gc, store := openSQLiteCollection(t, filepath.Join(t.TempDir(), "sbr.db"))
+	kept, err := store.Put([]byte("kept"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := store.Put([]byte("removed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = gc.AddMessages(Messages{Mms: []MMS{{Address: "+491711", Date: may2023, Parts: Parts{Part: []Part{{Seq: "0", Blob: kept}}}}}}); err != nil {
+		t.Fatal(err)
+	}
+	n, err := gc.RemoveUnreferencedBlobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("got %d removed attachments, want 1", n)
+	}
+	if _, err = store.Get(removed); err == nil {
+		t.Error("unreferenced attachment was kept")
+	}
+	if _, err = store.Get(kept); err != nil {
+		t.Errorf("referenced attachment was removed: %s", err)
+	}
+}
@@ -0,0 +1,46 @@
+package sbrdata
+
+// Store persists the collections of a GroupedCollection. The grouping logic decides which collection a record
+// belongs to, the store only reads and writes collections by key. Use SetStore to plug in a store, without it
+// a JSONStore in the base directory is used.
+type Store interface {
+	// Keys lists the keys of all persisted collections of the grouping period
+	Keys(period GroupPeriod) ([]string, error)
+	// Load reads the collection with key, returning an error wrapping os.ErrNotExist if there is none
+	Load(key string) (*Collection, error)
+	// Save persists all collections and documents of the batch all-or-nothing
+	Save(batch Batch) error
+	// Delete removes the collection with key
+	Delete(key string) error
+	// Lock acquires exclusive write access to the store. It fails if the store is locked already.
+	Lock() error
+	// Unlock releases the lock acquired by Lock
+	Unlock() error
+	// LoadDocument reads metadata like the manifest by name, returning an error wrapping os.ErrNotExist if there is none
+	LoadDocument(name string) ([]byte, error)
+	// Blobs returns the storage for MMS attachment payloads
+	Blobs() BlobStorage
+}
+
+// Batch is everything written by a single save of a GroupedCollection
+type Batch struct {
+	// Collections are the collections to persist, identified by their Key
+	Collections []*Collection
+	// Documents holds metadata like the manifest by name, a nil value removes the document
+	Documents map[string][]byte
+}
+
+// BlobStorage stores MMS attachment payloads addressed by their content
+type BlobStorage interface {
+	// Put stores data and returns the reference to retrieve it later on
+	Put(data []byte) (string, error)
+	// Get returns the content stored for ref
+	Get(ref string) ([]byte, error)
+}
+
+// BlobSweeper is implemented by blob storages able to remove attachments, see
+// GroupedCollection.RemoveUnreferencedBlobs
+type BlobSweeper interface {
+	// Sweep removes all attachments whose reference is not in referenced and returns the number removed
+	Sweep(referenced map[string]bool) (int, error)
+}
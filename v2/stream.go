@@ -0,0 +1,75 @@
+package sbrdata
+
+import (
+	"encoding/xml"
+	"io"
+)
+
+// StreamMessages reads an SMS Backup & Restore message export token by token and calls
+// onSms or onMms for every record found. Only a single record is held in memory at a time,
+// so the size of the export does not matter.
+// If one of the callbacks returns an error, reading stops and that error is returned.
+// A nil callback skips records of that kind.
+func StreamMessages(r io.Reader, onSms func(SMS) error, onMms func(MMS) error) error {
+	return streamElements(r, func(d *xml.Decoder, se xml.StartElement) error {
+		switch se.Name.Local {
+		case "sms":
+			if onSms == nil {
+				return d.Skip()
+			}
+			var s SMS
+			if err := d.DecodeElement(&s, &se); err != nil {
+				return err
+			}
+			return onSms(s)
+		case "mms":
+			if onMms == nil {
+				return d.Skip()
+			}
+			var m MMS
+			if err := d.DecodeElement(&m, &se); err != nil {
+				return err
+			}
+			return onMms(m)
+		}
+		return nil
+	})
+}
+
+// StreamCalls reads an SMS Backup & Restore call export token by token and calls onCall
+// for every call found. Only a single call is held in memory at a time.
+// If onCall returns an error, reading stops and that error is returned.
+func StreamCalls(r io.Reader, onCall func(Call) error) error {
+	return streamElements(r, func(d *xml.Decoder, se xml.StartElement) error {
+		if se.Name.Local != "call" {
+			return nil
+		}
+		var c Call
+		if err := d.DecodeElement(&c, &se); err != nil {
+			return err
+		}
+		return onCall(c)
+	})
+}
+
+// streamElements walks through all tokens of r and hands every start element to handle.
+// handle is responsible for consuming the element if it decodes it.
+func streamElements(r io.Reader, handle func(d *xml.Decoder, se xml.StartElement) error) error {
+	d := xml.NewDecoder(r)
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if err := handle(d, se); err != nil {
+			return err
+		}
+	}
+}
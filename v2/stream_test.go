@@ -0,0 +1,91 @@
+package sbrdata
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// writeExport writes a message export of n SMS, every tenth followed by an MMS, to w and closes it
+func writeExport(w *io.PipeWriter, n int) {
+	_, _ = io.WriteString(w, "<?xml version='1.0' encoding='UTF-8' standalone='yes' ?>\n<!--File Created By SMS Backup & Restore-->\n")
+	_, _ = fmt.Fprintf(w, "<smses count=\"%d\">\n", n+n/10)
+	for i := 0; i < n; i++ {
+		_, _ = fmt.Fprintf(w, "  <sms address=\"+4917%d\" date=\"%d\" type=\"1\" body=\"line&#10;break &amp; &lt;tag&gt; %d 😀\" />\n", i, 1683676800000+i, i)
+		if i%10 == 0 {
+			_, _ = fmt.Fprintf(w, "  <mms date=\"%d\" msg_box=\"1\" address=\"+4917%d\"><parts><part seq=\"0\" ct=\"text/plain\" text=\"part %d\" /></parts><addrs><addr address=\"+4917%d\" type=\"137\" /></addrs></mms>\n", 1683676800000+i, i, i, i)
+		}
+	}
+	_, _ = io.WriteString(w, "</smses>\n")
+	_ = w.Close()
+}
+
+func TestStreamMessages(t *testing.T) {
+	const n = 20000
+	r, w := io.Pipe()
+	defer r.Close()
+	go writeExport(w, n)
+	var sms, mms int
+	err := StreamMessages(r, func(s SMS) error {
+		if want := fmt.Sprintf("line\nbreak & <tag> %d 😀", sms); s.Body != want {
+			return fmt.Errorf("got body %q, want %q", s.Body, want)
+		}
+		sms++
+		return nil
+	}, func(m MMS) error {
+		if len(m.Parts.Part) != 1 || len(m.Addrs.Addr) != 1 || m.Parts.Part[0].AttrText != fmt.Sprintf("part %d", mms*10) {
+			return fmt.Errorf("got %+v, want an MMS with one part and address", m)
+		}
+		mms++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sms != n || mms != n/10 {
+		t.Errorf("got %d sms and %d mms, want %d and %d", sms, mms, n, n/10)
+	}
+}
+
+func TestStreamMessagesSkipsKind(t *testing.T) {
+	r, w := io.Pipe()
+	defer r.Close()
+	go writeExport(w, 100)
+	var mms int
+	if err := StreamMessages(r, nil, func(m MMS) error { mms++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if mms != 10 {
+		t.Errorf("got %d mms, want 10", mms)
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	stop := errors.New("stop")
+	tests := []struct {
+		name    string
+		export  string
+		wantErr error
+	}{
+		{name: "callback error", export: `<calls><call number="1" /><call number="2" /></calls>`, wantErr: stop},
+		{name: "unclosed element", export: `<calls><call number="1"`},
+		{name: "mismatched end", export: `<calls><call number="1"></sms></calls>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := StreamCalls(strings.NewReader(tt.export), func(c Call) error {
+				calls++
+				return stop
+			})
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if tt.wantErr != nil && (!errors.Is(err, tt.wantErr) || calls != 1) {
+				t.Errorf("got %v after %d calls, want %v after the first", err, calls, tt.wantErr)
+			}
+		})
+	}
+}
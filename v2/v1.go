@@ -0,0 +1,75 @@
+package sbrdata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrV2Collection is returned by MigrateV1 for files already written by this package
+var ErrV2Collection = errors.New("collection is not in v1 format")
+
+// storedCollection is the JSON layout of collection files of both versions. The v1 package names the
+// message lists SMS and MMS and writes no key. Decoding prefers the field matching the case exactly,
+// so a single pass tells the versions apart.
+type storedCollection struct {
+	Key   *string
+	Calls []Call
+	Sms   *[]SMS `json:"Sms"`
+	Mms   *[]MMS `json:"Mms"`
+	V1Sms *[]SMS `json:"SMS"`
+	V1Mms *[]MMS `json:"MMS"`
+}
+
+// decodeCollection decodes a collection file and tells whether it was written by the v1 package. Collections of
+// the v1 package are marked as changed to be written in the current format on the next save. JSON having the
+// message lists of both versions is refused, as one of them would be dropped.
+func decodeCollection(data []byte) (*Collection, bool, error) {
+	var stored storedCollection
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, false, err
+	}
+	v1 := stored.V1Sms != nil || stored.V1Mms != nil
+	if v1 && (stored.Sms != nil || stored.Mms != nil || stored.Key != nil) {
+		return nil, false, errors.New("collection mixes v1 and v2 fields")
+	}
+	coll := &Collection{Calls: stored.Calls, dirty: v1}
+	if stored.Key != nil {
+		coll.Key = *stored.Key
+	}
+	if sms := firstSet(stored.Sms, stored.V1Sms); sms != nil {
+		coll.Sms = *sms
+	}
+	if mms := firstSet(stored.Mms, stored.V1Mms); mms != nil {
+		coll.Mms = *mms
+	}
+	return coll, v1, nil
+}
+
+// firstSet returns the first of values not being nil
+func firstSet[T any](values ...*T) *T {
+	for _, v := range values {
+		if v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+// MigrateV1 writes a collection file of the v1 package into a new grouped base directory configured by opts,
+// typically SetBaseDirectory and SetGroupPeriod. See RepartitionFile for details. Files not written by the v1
+// package are refused with ErrV2Collection.
+func MigrateV1(file string, opts ...GroupedCollectionOption) error {
+	data, err := readCollectionFile(file, nil, false)
+	if err != nil {
+		return err
+	}
+	_, v1, err := decodeCollection(data)
+	if err != nil {
+		return fmt.Errorf("could not read %q: %w", file, err)
+	}
+	if !v1 {
+		return fmt.Errorf("could not migrate %q: %w", file, ErrV2Collection)
+	}
+	return RepartitionFile(file, opts...)
+}
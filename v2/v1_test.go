@@ -0,0 +1,70 @@
+package sbrdata
+
+import (
+	"testing"
+)
+
+func TestDecodeCollection(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		v1      bool
+		wantErr bool
+		want    Collection
+	}{
+		{
+			name: "v2",
+			data: `{"Key":"2023/05","Calls":[{"Number":"1"}],"Sms":[{"Address":"2"}],"Mms":[{"Address":"3"}]}`,
+			want: Collection{Key: "2023/05", Calls: []Call{{Number: "1"}}, Sms: []SMS{{Address: "2"}}, Mms: []MMS{{Address: "3"}}},
+		},
+		{
+			name: "v1",
+			data: `{"Calls":[{"Number":"1"}],"SMS":[{"Address":"2"}],"MMS":[{"Address":"3"}]}`,
+			v1:   true,
+			want: Collection{Calls: []Call{{Number: "1"}}, Sms: []SMS{{Address: "2"}}, Mms: []MMS{{Address: "3"}}, dirty: true},
+		},
+		{
+			name: "calls only",
+			data: `{"Calls":[{"Number":"1"}]}`,
+			want: Collection{Calls: []Call{{Number: "1"}}},
+		},
+		{
+			name:    "mixed",
+			data:    `{"Key":"2023/05","SMS":[{"Address":"2"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "damaged",
+			data:    `{"SMS":`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			coll, v1, err := decodeCollection([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if v1 != tt.v1 {
+				t.Errorf("got v1 %t, want %t", v1, tt.v1)
+			}
+			if coll.Key != tt.want.Key || coll.dirty != tt.want.dirty || len(coll.Calls) != len(tt.want.Calls) ||
+				len(coll.Sms) != len(tt.want.Sms) || len(coll.Mms) != len(tt.want.Mms) {
+				t.Fatalf("got %+v, want %+v", coll, tt.want)
+			}
+			for i := range coll.Sms {
+				if coll.Sms[i].Address != tt.want.Sms[i].Address {
+					t.Errorf("got sms %+v, want %+v", coll.Sms[i], tt.want.Sms[i])
+				}
+			}
+			for i := range coll.Mms {
+				if coll.Mms[i].Address != tt.want.Mms[i].Address {
+					t.Errorf("got mms %+v, want %+v", coll.Mms[i], tt.want.Mms[i])
+				}
+			}
+		})
+	}
+}